@@ -1,69 +1,143 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/sha512"
-	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"time"
+	"math/big"
+	"net/http"
 )
 
-// PuKey is the corresponding public key
-var PuKey *rsa.PublicKey
+// maxSignedBody is the most we'll read of a signed request's body. Image
+//	uploads that don't fit should be streamed with the signature in the
+//	X-Signature header instead.
+const maxSignedBody = 10000000
 
-func init() {
-	pubStr, err := ioutil.ReadFile("/etc/pki/public.pem")
-	if err != nil {
-		panic("Couldn't open public key file")
-	}
-	block, _ := pem.Decode([]byte(pubStr))
-	if block == nil {
-		panic("Couldn't decode public key from bytearray.")
-	}
-	puKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+// signatureHeader carries the signed object (base64-encoded JSON) for
+//	requests whose body is something else, like an image being uploaded.
+const signatureHeader = "X-Signature"
 
-	if err != nil {
-		log.Print(err.Error())
-		panic("Couldn't parse public key.")
-	}
-	PuKey = puKey.(*rsa.PublicKey)
+// contextKey keeps our request context values apart from everyone else's.
+type contextKey int
+
+const (
+	signerKey contextKey = iota
+	payloadKey
+)
+
+// Authenticate wraps a handler for a route that needs a signed request.
+//	The signature is checked here, once, before the inner handler runs;
+//	anything that fails gets a 401 with an ErrorResponse and never gets
+//	that far. The inner handler can pick up the signed payload with
+//	SignedPayload and the signing key with SignerID, and can still read
+//	the raw body from r.Body if it needs to.
+//
+//	The signed object is normally the request body. If it comes in the
+//	X-Signature header instead, the body isn't touched here at all, so
+//	the handler can stream it. Either way the signature covers the
+//	request's method and path, so it can't be replayed on another route.
+func Authenticate(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var signed []byte
+		if header := r.Header.Get(signatureHeader); header != "" {
+			var err error
+			if signed, err = base64.StdEncoding.DecodeString(header); err != nil {
+				WriteError(w, http.StatusBadRequest, "couldn't decode "+signatureHeader+" header")
+				return
+			}
+		} else {
+			// Don't allow people to flood our API with data
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignedBody+1))
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "couldn't read request body")
+				return
+			}
+			r.Body.Close()
+			if len(body) > maxSignedBody {
+				WriteError(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			signed = body
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		var payload json.RawMessage
+		keyID, err := Verify(r.Method, r.URL.EscapedPath(), signed, &payload)
+		if err != nil {
+			log.Printf("Unauthorized access attempt on %s (key %q): %v", name, keyID, err)
+			WriteError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		log.Printf("%s authorized for key %s", name, keyID)
+
+		ctx := context.WithValue(r.Context(), signerKey, keyID)
+		ctx = context.WithValue(ctx, payloadKey, []byte(payload))
+
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SignerID returns the ID of the key that signed the request.
+func SignerID(r *http.Request) string {
+	id, _ := r.Context().Value(signerKey).(string)
+	return id
 }
 
-// Verify verifies the signature on the provided data.
-func Verify(signed []byte, container interface{}) error {
-	// If the nonce has expired or is wrong, just end it
-	if NonceIsOlderThan(30 * time.Minute) {
-		UpdateNonce()
-		return errors.New("nonce was too old")
+// SignedPayload decodes the signed payload of the request into v. A
+//	request without a payload leaves v alone.
+func SignedPayload(r *http.Request, v interface{}) error {
+	payload, _ := r.Context().Value(payloadKey).([]byte)
+	if len(payload) == 0 {
+		return nil
 	}
+	return json.Unmarshal(payload, v)
+}
+
+// Verify verifies the signature on the provided data, made for a request
+//	with the given method and (escaped) path, and returns the ID of the
+//	key that signed it. Requests name their key with KeyID; those that
+//	don't are checked against the default key.
+func Verify(method string, path string, signed []byte, container interface{}) (string, error) {
 	// Grab our data
 	type signedObj struct {
 		Payload []byte
 		Nonce   string
 		Sig     string
+		KeyID   string
 	}
 	var data signedObj
 	if err := json.Unmarshal(signed, &data); err != nil {
 		log.Print(err)
-		return errors.New("couldn't unmarshal signed object")
+		return "", errors.New("couldn't unmarshal signed object")
+	}
+
+	key, err := keyring.Lookup(data.KeyID)
+	if err != nil {
+		return "", err
 	}
 
-	// Verify the nonce
+	// Verify the nonce. It's used up whether or not the signature is good.
 	nonce, _ := base64.StdEncoding.DecodeString(data.Nonce)
-	if !VerifyNonce(nonce) {
-		return errors.New("nonce verification failed")
+	if !challenges.Redeem(nonce) {
+		return key.ID, errors.New("nonce is unknown, used or expired")
 	}
 
-	// Create hash
-	//	Nonce first, then data
-	h := sha512.New()
-	h.Write(nonce)
+	// Build the signed message
+	//	Nonce first, then where it's going, then data
+	msg := signedMessage(nonce, method, path, nil)
 
 	// Things are looking okay, let's grab the data
 	if data.Payload != nil {
@@ -78,19 +152,88 @@ func Verify(signed []byte, container interface{}) error {
 		if string(payload) != string(data.Payload) {
 			if err := json.Unmarshal(data.Payload, &container); err != nil {
 				log.Print(err)
-				return errors.New("couldn't parse payload")
+				return key.ID, errors.New("couldn't parse payload")
 			}
-			h.Write(data.Payload)
+			msg = append(msg, data.Payload...)
 		}
 	}
 
-	// Get that hash
-	hash := h.Sum(nil)
-
 	// Verify signature
 	sig, _ := base64.StdEncoding.DecodeString(data.Sig)
-	err := rsa.VerifyPKCS1v15(PuKey, crypto.SHA512, hash, sig)
+	err = verifySignature(key, msg, sig)
 
 	// Return whether it was valid
-	return err
+	return key.ID, err
+}
+
+// signedMessage is what gets signed for a request: the nonce, then the
+//	method and path separated by a space and ended by a newline, then
+//	the payload.
+func signedMessage(nonce []byte, method string, path string, payload []byte) []byte {
+	msg := append([]byte{}, nonce...)
+	msg = append(msg, method+" "+path+"\n"...)
+	return append(msg, payload...)
+}
+
+// Names for the RSA signature schemes, as used in the Algorithm header
+//	of a key file.
+const (
+	algRSAPKCS1v15 = "RSA-PKCS1v15"
+	algRSAPSS      = "RSA-PSS"
+)
+
+// verifySignature checks sig over msg using whatever algorithm goes with
+//	the key:
+//
+//		RSA      PKCS#1 v1.5 or PSS over SHA-512
+//		ECDSA    P-256 over SHA-256, ASN.1 DER or raw r||s
+//		Ed25519  over the message itself
+func verifySignature(key *TrustedKey, msg []byte, sig []byte) error {
+	switch pub := key.Key.(type) {
+	case *rsa.PublicKey:
+		hash := sha512.Sum512(msg)
+		if key.Algorithm != algRSAPSS {
+			err := rsa.VerifyPKCS1v15(pub, crypto.SHA512, hash[:], sig)
+			if err == nil || key.Algorithm == algRSAPKCS1v15 {
+				return err
+			}
+		}
+		return rsa.VerifyPSS(pub, crypto.SHA512, hash[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		r, s, err := parseECDSASignature(sig)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return errors.New("ecdsa: verification error")
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, msg, sig) {
+			return errors.New("ed25519: verification error")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("can't check signatures from a %T", key.Key)
+}
+
+// parseECDSASignature pulls r and s out of either an ASN.1 DER signature
+//	(what most libraries produce) or a raw 64-byte r||s (what WebCrypto
+//	and a lot of hardware tokens produce).
+func parseECDSASignature(sig []byte) (*big.Int, *big.Int, error) {
+	var parsed struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &parsed); err == nil && len(rest) == 0 {
+		return parsed.R, parsed.S, nil
+	}
+
+	if len(sig) == 64 {
+		return new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]), nil
+	}
+	return nil, nil, errors.New("ecdsa: malformed signature")
 }
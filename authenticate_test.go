@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestKey makes a fresh RSA key, trusts it for signed requests and
+//	returns the private half for the test to sign with. The test starts
+//	with a fresh nonce store too.
+func useTestKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring.add(&TrustedKey{ID: defaultKeyID, Key: &key.PublicKey})
+	challenges = NewChallengeStore(4096, 30*time.Minute)
+	return key
+}
+
+// getNonce asks the router for a nonce the same way a client would.
+func getNonce(router http.Handler, path string) (Nonce, int) {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+	var nonce Nonce
+	json.Unmarshal(rec.Body.Bytes(), &nonce)
+	return nonce, rec.Code
+}
+
+// signRequest builds the body of a signed request to method and target
+//	(a path, maybe with a query string) carrying payload (which may be
+//	nil), signed with the default key.
+func signRequest(key crypto.Signer, nonce Nonce, method string, target string, payload []byte) []byte {
+	return signRequestAs(key, "", nonce, method, target, payload)
+}
+
+// signRequestAs is signRequest for the key with the given ID.
+func signRequestAs(key crypto.Signer, keyID string, nonce Nonce, method string, target string, payload []byte) []byte {
+	u, err := url.Parse(target)
+	if err != nil {
+		panic(err)
+	}
+	msg := signedMessage(nonce.Value, method, u.EscapedPath(), payload)
+	return signedBody(keyID, nonce, payload, signWith(key, msg))
+}
+
+// signWith signs msg the way a client holding key normally would.
+func signWith(key crypto.Signer, msg []byte) []byte {
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		hash := sha512.Sum512(msg)
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA512, hash[:])
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(msg)
+		sig, err = ecdsa.SignASN1(rand.Reader, k, hash[:])
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, msg)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// signedBody wraps up a signature the way Verify expects to see it.
+func signedBody(keyID string, nonce Nonce, payload []byte, sig []byte) []byte {
+	body, _ := json.Marshal(struct {
+		Payload []byte
+		Nonce   string
+		Sig     string
+		KeyID   string
+	}{
+		payload,
+		base64.StdEncoding.EncodeToString(nonce.Value),
+		base64.StdEncoding.EncodeToString(sig),
+		keyID,
+	})
+	return body
+}
+
+// post sends a POST with the given body and returns the status code.
+func post(router http.Handler, path string, body []byte) int {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+	return rec.Code
+}
+
+// get sends a plain GET and returns the response.
+func get(router http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// sendSigned sends a request with payload (marshalled to JSON) signed
+//	by key on a fresh nonce, and returns the response. GETs carry the
+//	signature in the X-Signature header, everything else in the body.
+func sendSigned(router http.Handler, key crypto.Signer, method string, path string, payload interface{}) *httptest.ResponseRecorder {
+	nonce, _ := getNonce(router, "/nonce/")
+	data, _ := json.Marshal(payload)
+	body := signRequest(key, nonce, method, path, data)
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest(method, path, nil)
+		req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(body))
+	} else {
+		req = httptest.NewRequest(method, path, bytes.NewReader(body))
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestVerifySingleUse(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	nonce, _ := getNonce(router, "/nonce/")
+	body := signRequest(key, nonce, "POST", "/posts/all/", nil)
+	if code := post(router, "/posts/all/", body); code != http.StatusOK {
+		t.Fatalf("signed request: expected %d, got %d", http.StatusOK, code)
+	}
+	if code := post(router, "/posts/all/", body); code != http.StatusUnauthorized {
+		t.Errorf("replayed request: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Swapping a nonce for a new one retires the old one, but only once
+	//	it's been around a while
+	old, _ := getNonce(router, "/nonce/")
+	if _, code := getNonce(router, "/nonce/update/?old="+base64.URLEncoding.EncodeToString(old.Value)); code != http.StatusForbidden {
+		t.Errorf("early nonce update: expected %d, got %d", http.StatusForbidden, code)
+	}
+	challenges.renewAfter = 0
+	fresh, code := getNonce(router, "/nonce/update/?old="+base64.URLEncoding.EncodeToString(old.Value))
+	if code != http.StatusAccepted {
+		t.Errorf("nonce update: expected %d, got %d", http.StatusAccepted, code)
+	}
+	if code := post(router, "/posts/all/", signRequest(key, old, "POST", "/posts/all/", nil)); code != http.StatusUnauthorized {
+		t.Errorf("revoked nonce: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	if code := post(router, "/posts/all/", signRequest(key, fresh, "POST", "/posts/all/", nil)); code != http.StatusOK {
+		t.Errorf("updated nonce: expected %d, got %d", http.StatusOK, code)
+	}
+}
+
+// TestConcurrentAuthentication has many clients fetch, rotate and use
+//	nonces at the same time, alongside clients sending junk. Run it with
+//	-race to check the nonce and key state for data races.
+func TestConcurrentAuthentication(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	const clients = 40
+	challenges.renewAfter = 0
+	challenges.perClient = 2 * clients
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	remember := func(n Nonce) {
+		mu.Lock()
+		defer mu.Unlock()
+		k := string(n.Value)
+		if seen[k] {
+			t.Error("the same nonce was handed out twice")
+		}
+		seen[k] = true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(2)
+
+		// An editor doing things properly
+		go func() {
+			defer wg.Done()
+
+			first, code := getNonce(router, "/nonce/")
+			if code != http.StatusOK {
+				t.Errorf("GET /nonce/: expected %d, got %d", http.StatusOK, code)
+				return
+			}
+			remember(first)
+
+			second, code := getNonce(router, "/nonce/update/?old="+base64.URLEncoding.EncodeToString(first.Value))
+			if code != http.StatusAccepted {
+				t.Errorf("GET /nonce/update/: expected %d, got %d", http.StatusAccepted, code)
+				return
+			}
+			remember(second)
+
+			body := signRequest(key, second, "POST", "/posts/all/", nil)
+			if code := post(router, "/posts/all/", body); code != http.StatusOK {
+				t.Errorf("signed request: expected %d, got %d", http.StatusOK, code)
+			}
+			if code := post(router, "/posts/all/", body); code != http.StatusUnauthorized {
+				t.Errorf("replayed request: expected %d, got %d", http.StatusUnauthorized, code)
+			}
+		}()
+
+		// Someone without the key
+		go func() {
+			defer wg.Done()
+
+			nonce, _ := getNonce(router, "/nonce/")
+			remember(nonce)
+			body, _ := json.Marshal(map[string]string{
+				"Nonce": base64.StdEncoding.EncodeToString(nonce.Value),
+				"Sig":   base64.StdEncoding.EncodeToString([]byte("forged")),
+			})
+			if code := post(router, "/posts/all/", body); code != http.StatusUnauthorized {
+				t.Errorf("forged request: expected %d, got %d", http.StatusUnauthorized, code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 3*clients {
+		t.Errorf("expected %d distinct nonces, saw %d", 3*clients, len(seen))
+	}
+}
+
+func TestSignatureAlgorithms(t *testing.T) {
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keyring = NewKeyring("", "")
+	keyring.add(&TrustedKey{ID: "rsa", Key: rsaKey.Public()})
+	keyring.add(&TrustedKey{ID: "rsa-pkcs1", Key: rsaKey.Public(), Algorithm: algRSAPKCS1v15})
+	keyring.add(&TrustedKey{ID: "ecdsa", Key: ecKey.Public()})
+	keyring.add(&TrustedKey{ID: "ed25519", Key: edKey.Public()})
+
+	pss := func(msg []byte) []byte {
+		hash := sha512.Sum512(msg)
+		sig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA512, hash[:], nil)
+		return sig
+	}
+	rawECDSA := func(msg []byte) []byte {
+		hash := sha256.Sum256(msg)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, hash[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	cases := []struct {
+		name  string
+		keyID string
+		sign  func(msg []byte) []byte
+		want  int
+	}{
+		{"RSA PKCS#1 v1.5", "rsa", func(msg []byte) []byte { return signWith(rsaKey, msg) }, http.StatusOK},
+		{"RSA-PSS", "rsa", pss, http.StatusOK},
+		{"RSA-PSS on a PKCS#1 v1.5 key", "rsa-pkcs1", pss, http.StatusUnauthorized},
+		{"ECDSA P-256 (DER)", "ecdsa", func(msg []byte) []byte { return signWith(ecKey, msg) }, http.StatusOK},
+		{"ECDSA P-256 (raw)", "ecdsa", rawECDSA, http.StatusOK},
+		{"Ed25519", "ed25519", func(msg []byte) []byte { return signWith(edKey, msg) }, http.StatusOK},
+		{"Ed25519 signature for an ECDSA key", "ecdsa", func(msg []byte) []byte { return signWith(edKey, msg) }, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		nonce, _ := getNonce(router, "/nonce/")
+		payload := []byte(`{}`)
+		msg := signedMessage(nonce.Value, "POST", "/posts/all/", payload)
+		body := signedBody(c.keyID, nonce, payload, c.sign(msg))
+		if code := post(router, "/posts/all/", body); code != c.want {
+			t.Errorf("%s: expected %d, got %d", c.name, c.want, code)
+		}
+	}
+}
+
+// TestSignedRoutes makes sure every route that changes something needs a
+//	signature, and that the middleware turns away unsigned requests.
+func TestSignedRoutes(t *testing.T) {
+	useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	for _, route := range routes {
+		if route.Method != "GET" && route.Method != "HEAD" && !route.Signed {
+			t.Errorf("route %s (%s %s) changes things but isn't signed", route.Name, route.Method, route.Pattern)
+		}
+		if !route.Signed {
+			continue
+		}
+
+		path := strings.Replace(route.Pattern, "{postID}", "1", -1)
+		path = strings.Replace(path, "{filename}", "x.png", -1)
+		path = strings.Replace(path, "{imageID}", "abc", -1)
+		path = strings.Replace(path, "{revision}", "1", -1)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(route.Method, path, strings.NewReader(`{"Sig": "bogus"}`)))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d, got %d", route.Name, http.StatusUnauthorized, rec.Code)
+			continue
+		}
+		var res ErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || res.Status != http.StatusUnauthorized {
+			t.Errorf("%s: unexpected error body %q", route.Name, rec.Body.String())
+		}
+	}
+}
+
+func TestSignatureCoversRoute(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/posts/all/", http.StatusOK},
+		{"POST", "/post/", http.StatusUnauthorized},
+		{"PUT", "/posts/all/", http.StatusUnauthorized},
+		{"POST", "/posts/all", http.StatusUnauthorized},
+	} {
+		nonce, _ := getNonce(router, "/nonce/")
+		if code := post(router, "/posts/all/", signRequest(key, nonce, c.method, c.path, nil)); code != c.want {
+			t.Errorf("signed for %s %s: expected %d, got %d", c.method, c.path, c.want, code)
+		}
+	}
+}
+
+func TestSignedPayloadReachesHandler(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	nonce, _ := getNonce(router, "/nonce/")
+	payload, _ := json.Marshal(Input{Title: "Signed and delivered", Body: "b"})
+	if code := post(router, "/post/", signRequest(key, nonce, "POST", "/post/", payload)); code != http.StatusOK && code != http.StatusCreated {
+		t.Fatalf("create: got %d", code)
+	}
+	if p, _ := postStore.PostByURLTitle("signed-and-delivered"); p.Body != "b" {
+		t.Errorf("post wasn't created from the signed payload: %+v", p)
+	}
+}
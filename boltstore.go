@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket names used in the bolt file.
+var (
+	boltPosts     = []byte("posts")
+	boltURLTitles = []byte("urltitles")
+	boltImages    = []byte("images")
+	boltRevisions = []byte("revisions")
+	boltRsvps     = []byte("rsvps")
+)
+
+// boltStore keeps everything in a single file on disk using BoltDB. Posts
+//	and images are keyed by ID, and a second bucket maps each urltitle to
+//	its post so that urltitles stay unique. Each post's revisions are in
+//	a bucket of their own, keyed by number.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore opens (or creates) the database file at path.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltPosts, boltURLTitles, boltImages, boltRevisions, boltRsvps} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return migrateImageIDs(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// Close releases the database file.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// postKey turns a post ID into a bolt key.
+func postKey(id uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, id)
+	return key
+}
+
+// InsertPost implements PostStore.
+func (s *boltStore) InsertPost(post Post) (Post, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(boltPosts)
+		titles := tx.Bucket(boltURLTitles)
+
+		key := postKey(post.ID)
+		if posts.Get(key) != nil {
+			return ErrExists
+		}
+		for titles.Get([]byte(post.URLTitle)) != nil {
+			post.URLTitle += "0"
+		}
+
+		data, err := json.Marshal(post)
+		if err != nil {
+			return err
+		}
+		if err := posts.Put(key, data); err != nil {
+			return err
+		}
+		return titles.Put([]byte(post.URLTitle), key)
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// UpdatePost implements PostStore. Bolt only lets one write happen at a
+//	time, so change runs inside it.
+func (s *boltStore) UpdatePost(id uint32, change func(post *Post) error) (Post, error) {
+	var post Post
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		posts := tx.Bucket(boltPosts)
+		titles := tx.Bucket(boltURLTitles)
+
+		key := postKey(id)
+		if err := boltGet(posts, key, &post); err != nil {
+			return err
+		}
+		oldTitle := post.URLTitle
+		if err := change(&post); err != nil {
+			return err
+		}
+		post.ID = id
+
+		// Keep the urltitle index in step if the urltitle changed
+		if oldTitle != post.URLTitle {
+			if titles.Get([]byte(post.URLTitle)) != nil {
+				return fmt.Errorf("urltitle %q is already in use", post.URLTitle)
+			}
+			if err := titles.Delete([]byte(oldTitle)); err != nil {
+				return err
+			}
+			if err := titles.Put([]byte(post.URLTitle), key); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.Marshal(post)
+		if err != nil {
+			return err
+		}
+		return posts.Put(key, data)
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// PostByID implements PostStore.
+func (s *boltStore) PostByID(id uint32) (Post, error) {
+	var post Post
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltPosts), postKey(id), &post)
+	})
+	return post, err
+}
+
+// PostByURLTitle implements PostStore.
+func (s *boltStore) PostByURLTitle(urlTitle string) (Post, error) {
+	var post Post
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(boltURLTitles).Get([]byte(urlTitle))
+		if key == nil {
+			return ErrNotFound
+		}
+		return boltGet(tx.Bucket(boltPosts), key, &post)
+	})
+	return post, err
+}
+
+// URLTitleExists implements PostStore.
+func (s *boltStore) URLTitleExists(urlTitle string) (bool, error) {
+	exists := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(boltURLTitles).Get([]byte(urlTitle)) != nil
+		return nil
+	})
+	return exists, err
+}
+
+// ListPosts implements PostStore.
+func (s *boltStore) ListPosts(visibleOnly bool) (Posts, error) {
+	posts := Posts{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltPosts).ForEach(func(k, v []byte) error {
+			var post Post
+			if err := json.Unmarshal(v, &post); err != nil {
+				return err
+			}
+			if visibleOnly && !post.Visible {
+				return nil
+			}
+			posts = append(posts, post)
+			return nil
+		})
+	})
+	return posts, err
+}
+
+// InsertImage implements ImageStore.
+func (s *boltStore) InsertImage(img Image) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(boltImages)
+		if images.Get([]byte(img.ID)) != nil {
+			return ErrExists
+		}
+		data, err := json.Marshal(img)
+		if err != nil {
+			return err
+		}
+		return images.Put([]byte(img.ID), data)
+	})
+}
+
+// ImageByID implements ImageStore.
+func (s *boltStore) ImageByID(id string) (Image, error) {
+	var img Image
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltImages), []byte(id), &img)
+	})
+	return img, err
+}
+
+// SaveImage implements ImageStore.
+func (s *boltStore) SaveImage(img Image) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(boltImages)
+		if images.Get([]byte(img.ID)) == nil {
+			return ErrNotFound
+		}
+		data, err := json.Marshal(img)
+		if err != nil {
+			return err
+		}
+		return images.Put([]byte(img.ID), data)
+	})
+}
+
+// DeleteImage implements ImageStore.
+func (s *boltStore) DeleteImage(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(boltImages)
+		if images.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return images.Delete([]byte(id))
+	})
+}
+
+// migrateImageIDs rekeys images stored by date, before images had IDs.
+//	Records for the same file end up under the same ID, and are merged.
+func migrateImageIDs(tx *bolt.Tx) error {
+	images := tx.Bucket(boltImages)
+
+	var old [][]byte
+	err := images.ForEach(func(k, v []byte) error {
+		var img Image
+		if err := json.Unmarshal(v, &img); err != nil {
+			return err
+		}
+		if img.ID == "" {
+			old = append(old, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range old {
+		var img Image
+		if err := boltGet(images, k, &img); err != nil {
+			return err
+		}
+		img.ID = legacyImageID(img.Filename)
+
+		// The same file uploaded twice had two records; now there's one
+		var other Image
+		err := boltGet(images, []byte(img.ID), &other)
+		if err == nil {
+			img = mergeImages([]Image{img, other})
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		data, err := json.Marshal(img)
+		if err != nil {
+			return err
+		}
+		if err := images.Delete(k); err != nil {
+			return err
+		}
+		if err := images.Put([]byte(img.ID), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListImages implements ImageStore.
+func (s *boltStore) ListImages() (Images, error) {
+	images := Images{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltImages).ForEach(func(k, v []byte) error {
+			var img Image
+			if err := json.Unmarshal(v, &img); err != nil {
+				return err
+			}
+			images = append(images, img)
+			return nil
+		})
+	})
+	return images, err
+}
+
+// PutRSVP stores an RSVP. Like the memory store, this is how RSVPs get
+//	seeded since there is no API route for creating them.
+func (s *boltStore) PutRSVP(rsvp Rsvp) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data, err := json.Marshal(rsvp)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltRsvps).Put([]byte(rsvp.ShortCode), data)
+	})
+}
+
+// RSVPByShortCode implements RsvpStore.
+func (s *boltStore) RSVPByShortCode(rescode string) (Rsvp, error) {
+	var rsvp Rsvp
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltRsvps), []byte(rescode), &rsvp)
+	})
+	return rsvp, err
+}
+
+// UpdateRSVP implements RsvpStore.
+func (s *boltStore) UpdateRSVP(rescode string, attending bool, mon int, sun int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rsvps := tx.Bucket(boltRsvps)
+
+		var rsvp Rsvp
+		if err := boltGet(rsvps, []byte(rescode), &rsvp); err != nil {
+			return err
+		}
+		rsvp.Attending = attending
+		rsvp.Updated = true
+		rsvp.MonConfirm = mon
+		rsvp.SunConfirm = sun
+
+		data, err := json.Marshal(rsvp)
+		if err != nil {
+			return err
+		}
+		return rsvps.Put([]byte(rescode), data)
+	})
+}
+
+// revisionKey turns a revision number into a bolt key.
+func revisionKey(number int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(number))
+	return key
+}
+
+// InsertRevision implements RevisionStore. Each post's bucket keeps
+//	its sequence at the highest revision number in it, for
+//	AppendRevision.
+func (s *boltStore) InsertRevision(rev Revision) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		revs, err := tx.Bucket(boltRevisions).CreateBucketIfNotExists(postKey(rev.PostID))
+		if err != nil {
+			return err
+		}
+		key := revisionKey(rev.Number)
+		if revs.Get(key) != nil {
+			return ErrExists
+		}
+		if n := uint64(rev.Number); n > revs.Sequence() {
+			if err := revs.SetSequence(n); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		return revs.Put(key, data)
+	})
+}
+
+// AppendRevision implements RevisionStore.
+func (s *boltStore) AppendRevision(rev Revision) (Revision, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		revs, err := tx.Bucket(boltRevisions).CreateBucketIfNotExists(postKey(rev.PostID))
+		if err != nil {
+			return err
+		}
+		n, err := revs.NextSequence()
+		if err != nil {
+			return err
+		}
+		rev.Number = int(n)
+		data, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		return revs.Put(revisionKey(rev.Number), data)
+	})
+	if err != nil {
+		return Revision{}, err
+	}
+	return rev, nil
+}
+
+// Revisions implements RevisionStore.
+func (s *boltStore) Revisions(postID uint32) ([]Revision, error) {
+	revisions := []Revision{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(boltRevisions).Bucket(postKey(postID))
+		if revs == nil {
+			return nil
+		}
+		return revs.ForEach(func(k, v []byte) error {
+			var rev Revision
+			if err := json.Unmarshal(v, &rev); err != nil {
+				return err
+			}
+			revisions = append(revisions, rev)
+			return nil
+		})
+	})
+	return revisions, err
+}
+
+// RevisionByNumber implements RevisionStore.
+func (s *boltStore) RevisionByNumber(postID uint32, number int) (Revision, error) {
+	var rev Revision
+	err := s.db.View(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(boltRevisions).Bucket(postKey(postID))
+		if revs == nil {
+			return ErrNotFound
+		}
+		return boltGet(revs, revisionKey(number), &rev)
+	})
+	return rev, err
+}
+
+// boltGet decodes the JSON stored under key, or returns ErrNotFound.
+func boltGet(b *bolt.Bucket, key []byte, v interface{}) error {
+	data := b.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
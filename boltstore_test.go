@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStoreSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blog.db")
+
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := Post{ID: 7, Title: "Hello", URLTitle: "hello", Visible: true, Date: time.Now()}
+	if _, err := s.InsertPost(post); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := s.InsertPost(Post{ID: 8, URLTitle: "hello"}); err != nil || p.URLTitle != "hello0" {
+		t.Errorf("duplicate urltitle should get a 0 added, got %q (%v)", p.URLTitle, err)
+	}
+	if _, err := s.InsertPost(Post{ID: 7, URLTitle: "other"}); err != ErrExists {
+		t.Errorf("duplicate ID should give ErrExists, got %v", err)
+	}
+	if _, err := s.InsertPost(Post{ID: 9, URLTitle: "hidden"}); err != nil {
+		t.Fatal(err)
+	}
+	img := Image{ID: "abc", Filename: "abc.png", Date: time.Now()}
+	if err := s.InsertImage(img); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []int{1, 2} {
+		if err := s.InsertRevision(Revision{PostID: 7, Number: n, Title: "Hello", Date: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.InsertRevision(Revision{PostID: 7, Number: 2}); err != ErrExists {
+		t.Errorf("expected ErrExists for a taken revision number, got %v", err)
+	}
+	if rev, err := s.AppendRevision(Revision{PostID: 7, Title: "Hello", Date: time.Now()}); err != nil || rev.Number != 3 {
+		t.Errorf("expected the appended revision to be number 3, got %d (%v)", rev.Number, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and make sure everything is still there
+	s, err = openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	got, err := s.PostByURLTitle("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 || got.Title != "Hello" {
+		t.Errorf("unexpected post after reopening: %+v", got)
+	}
+	if visible, _ := s.ListPosts(true); len(visible) != 1 {
+		t.Errorf("expected one visible post, got %d", len(visible))
+	}
+	if all, _ := s.ListPosts(false); len(all) != 3 {
+		t.Errorf("expected three posts, got %d", len(all))
+	}
+	if _, err := s.ImageByID("abc"); err != nil {
+		t.Errorf("image lost after reopening: %v", err)
+	}
+	if revs, _ := s.Revisions(7); len(revs) != 3 || revs[0].Number != 1 || revs[2].Number != 3 {
+		t.Errorf("unexpected revisions after reopening: %+v", revs)
+	}
+	if rev, err := s.AppendRevision(Revision{PostID: 7, Date: time.Now()}); err != nil || rev.Number != 4 {
+		t.Errorf("expected the next revision to be number 4 after reopening, got %d (%v)", rev.Number, err)
+	}
+	if _, err := s.RevisionByNumber(9, 1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// Renaming a post moves its urltitle
+	if _, err := s.UpdatePost(got.ID, func(p *Post) error { p.URLTitle = "hello-again"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.URLTitleExists("hello"); exists {
+		t.Error("old urltitle should have been released")
+	}
+	if _, err := s.PostByID(12345); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltStoreImageIDMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blog.db")
+
+	// An image from before images had IDs, keyed by its date,
+	s, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//	and the same file uploaded again later
+	old := Image{Filename: "9e107d9d372bb6826bd81d3542a419d6.png", Title: "fox", Date: time.Now().Add(-time.Hour)}
+	again := Image{Filename: old.Filename, Title: "fox again", AltText: "A quick brown fox", Date: time.Now()}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		for _, img := range []Image{again, old} {
+			data, _ := json.Marshal(img)
+			if err := tx.Bucket(boltImages).Put([]byte(img.Date.Format(time.RFC3339Nano)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	img, err := s.ImageByID("9e107d9d372bb6826bd81d3542a419d6")
+	if err != nil || img.Filename != old.Filename {
+		t.Errorf("old image not found by its new ID: %+v, %v", img, err)
+	}
+	if img.Title != old.Title || img.AltText != again.AltText || !img.Date.Equal(old.Date) {
+		t.Errorf("duplicates weren't merged into the first upload: %+v", img)
+	}
+	if images, _ := s.ListImages(); len(images) != 1 {
+		t.Errorf("expected one image after migrating, got %d", len(images))
+	}
+}
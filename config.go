@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds everything about the server that changes between
+//	deployments. Values come from (in increasing order of precedence)
+//	the defaults below, a JSON config file, API_* environment variables
+//	and command-line flags.
+type Config struct {
+	Listen         string     `json:"listen"`
+	Store          string     `json:"store"`
+	MongoAddr      string     `json:"mongoaddr"`
+	DBFile         string     `json:"dbfile"`
+	PublicKey      string     `json:"publickey"`
+	KeyDir         string     `json:"keydir"`
+	ImageStorage   string     `json:"imagestorage"`
+	ImageDir       string     `json:"imagedir"`
+	ImageURL       string     `json:"imageurl"`
+	UploadDir      string     `json:"uploaddir"`
+	S3             S3Config   `json:"s3"`
+	MaxImageSize   int64      `json:"maximagesize"`
+	ThumbSize      int64      `json:"thumbsize"`
+	ImageWidths    string     `json:"imagewidths"`
+	ImageWebP      bool       `json:"imagewebp"`
+	CORSOrigin     string     `json:"corsorigin"`
+	TrustedProxies string     `json:"trustedproxies"`
+	RenderMarkdown bool       `json:"rendermarkdown"`
+	Feed           FeedConfig `json:"feed"`
+	Dev            bool       `json:"dev"`
+}
+
+// FeedConfig describes the blog for the RSS feed.
+type FeedConfig struct {
+	Title       string `json:"title"`
+	Link        string `json:"link"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+	Email       string `json:"email"`
+}
+
+// S3Config says where to keep images when they go to an S3-compatible
+//	object store. PublicURL is where the bucket can be read from, if
+//	that isn't the endpoint itself (a CDN, say).
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region"`
+	AccessKey string `json:"accesskey"`
+	SecretKey string `json:"secretkey"`
+	PublicURL string `json:"publicurl"`
+}
+
+// config is the configuration the server is running with.
+var config = DefaultConfig()
+
+// DefaultConfig returns the configuration for our production server.
+func DefaultConfig() Config {
+	return Config{
+		Listen:       ":8080",
+		Store:        "mongo",
+		MongoAddr:    "mongodb:27017",
+		DBFile:       "blog.db",
+		PublicKey:    "/etc/pki/public.pem",
+		ImageStorage: "local",
+		ImageDir:     "/etc/img/",
+		ImageURL:     "https://nicocourts.com/img/",
+		S3: S3Config{
+			Region: "us-east-1",
+		},
+		MaxImageSize: 10 << 20,
+		ThumbSize:    200,
+		ImageWidths:  "480,960,1600",
+		CORSOrigin:   "*",
+		Feed: FeedConfig{
+			Title:       "NicoCourts.com blog",
+			Link:        "https://nicocourts.com/blog",
+			Description: "math, life, nature, etc",
+			Author:      "Nico Courts",
+			Email:       "ncourts@uw.edu",
+		},
+	}
+}
+
+// setting ties a config value to its flag and environment variable. The
+//	environment variable is the flag name in capitals with an API_ prefix,
+//	so -image-dir can also be set with API_IMAGE_DIR.
+type setting struct {
+	name  string
+	usage string
+	str   func(c *Config) *string
+	boolp func(c *Config) *bool
+	intp  func(c *Config) *int64
+}
+
+var settings = []setting{
+	{name: "listen", usage: "address to listen on", str: func(c *Config) *string { return &c.Listen }},
+	{name: "store", usage: "storage backend to use (mongo, memory or bolt)", str: func(c *Config) *string { return &c.Store }},
+	{name: "mongo", usage: "MongoDB server address", str: func(c *Config) *string { return &c.MongoAddr }},
+	{name: "db", usage: "database file for the bolt backend", str: func(c *Config) *string { return &c.DBFile }},
+	{name: "public-key", usage: "PEM file holding the default public key for signed requests", str: func(c *Config) *string { return &c.PublicKey }},
+	{name: "key-dir", usage: "directory of editors' public keys, one <key id>.pem per key", str: func(c *Config) *string { return &c.KeyDir }},
+	{name: "image-storage", usage: "where to keep image files (local or s3)", str: func(c *Config) *string { return &c.ImageStorage }},
+	{name: "image-dir", usage: "directory uploaded images are kept in", str: func(c *Config) *string { return &c.ImageDir }},
+	{name: "image-url", usage: "public URL the image directory is served from", str: func(c *Config) *string { return &c.ImageURL }},
+	{name: "upload-dir", usage: "directory uploads are kept in while they're checked (defaults to the image directory, or the system's temporary directory with s3)", str: func(c *Config) *string { return &c.UploadDir }},
+	{name: "s3-endpoint", usage: "S3-compatible server to keep images on", str: func(c *Config) *string { return &c.S3.Endpoint }},
+	{name: "s3-bucket", usage: "S3 bucket to keep images in", str: func(c *Config) *string { return &c.S3.Bucket }},
+	{name: "s3-region", usage: "region of the S3 bucket", str: func(c *Config) *string { return &c.S3.Region }},
+	{name: "s3-access-key", usage: "S3 access key ID", str: func(c *Config) *string { return &c.S3.AccessKey }},
+	{name: "s3-secret-key", usage: "S3 secret access key", str: func(c *Config) *string { return &c.S3.SecretKey }},
+	{name: "s3-public-url", usage: "public URL of the S3 bucket, if not the endpoint", str: func(c *Config) *string { return &c.S3.PublicURL }},
+	{name: "max-image-size", usage: "largest image upload accepted, in bytes", intp: func(c *Config) *int64 { return &c.MaxImageSize }},
+	{name: "thumb-size", usage: "largest width or height of image thumbnails, in pixels", intp: func(c *Config) *int64 { return &c.ThumbSize }},
+	{name: "image-widths", usage: "comma-separated widths to make resized copies of images at", str: func(c *Config) *string { return &c.ImageWidths }},
+	{name: "image-webp", usage: "store resized images as WebP when that's smaller", boolp: func(c *Config) *bool { return &c.ImageWebP }},
+	{name: "render-markdown", usage: "make post bodies from their Markdown instead of taking the client's HTML", boolp: func(c *Config) *bool { return &c.RenderMarkdown }},
+	{name: "cors-origin", usage: "value for Access-Control-Allow-Origin", str: func(c *Config) *string { return &c.CORSOrigin }},
+	{name: "trusted-proxies", usage: "comma-separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed", str: func(c *Config) *string { return &c.TrustedProxies }},
+	{name: "feed-title", usage: "title of the RSS feed", str: func(c *Config) *string { return &c.Feed.Title }},
+	{name: "feed-link", usage: "link to the blog for the RSS feed", str: func(c *Config) *string { return &c.Feed.Link }},
+	{name: "feed-description", usage: "description of the RSS feed", str: func(c *Config) *string { return &c.Feed.Description }},
+	{name: "feed-author", usage: "author name for the RSS feed", str: func(c *Config) *string { return &c.Feed.Author }},
+	{name: "feed-email", usage: "author email for the RSS feed", str: func(c *Config) *string { return &c.Feed.Email }},
+	{name: "dev", usage: "development mode (talks to a local MongoDB)", boolp: func(c *Config) *bool { return &c.Dev }},
+}
+
+func (s setting) env() string {
+	return "API_" + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+// set parses value into the setting's field of c.
+func (s setting) set(c *Config, value string) error {
+	if s.boolp != nil {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not true or false", s.name, value)
+		}
+		*s.boolp(c) = b
+		return nil
+	}
+	if s.intp != nil {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a whole number", s.name, value)
+		}
+		*s.intp(c) = n
+		return nil
+	}
+	*s.str(c) = value
+	return nil
+}
+
+// LoadConfig builds the configuration from the command-line arguments
+//	(without the program name), the environment and the config file
+//	named by -config or API_CONFIG, then checks that it makes sense.
+func LoadConfig(args []string) (Config, error) {
+	cfg := DefaultConfig()
+
+	// Flags win over everything, but we need -config before we can read
+	//	the file, so parse them first and apply them last.
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("API_CONFIG"), "JSON config file")
+	flagVals := make(map[string]*string)
+	for _, s := range settings {
+		usage := s.usage + " (env " + s.env() + ")"
+		switch {
+		case s.boolp != nil:
+			flagVals[s.name] = new(string)
+			fs.Var(boolFlag{flagVals[s.name]}, s.name, usage)
+		case s.intp != nil:
+			flagVals[s.name] = fs.String(s.name, strconv.FormatInt(*s.intp(&cfg), 10), usage)
+		default:
+			flagVals[s.name] = fs.String(s.name, *s.str(&cfg), usage)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return cfg, fmt.Errorf("couldn't read config file: %v", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("couldn't parse config file %s: %v", *path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(&cfg, value); err != nil {
+				return cfg, fmt.Errorf("%s: %v", s.env(), err)
+			}
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				err = s.set(&cfg, *flagVals[s.name])
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	// A dev server talks to a local database unless told otherwise
+	if cfg.Dev && cfg.MongoAddr == DefaultConfig().MongoAddr {
+		cfg.MongoAddr = "localhost:27017"
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration and reports every problem it finds.
+func (c Config) Validate() error {
+	var problems []string
+	complain := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Listen == "" {
+		complain("listen address is empty")
+	}
+	switch c.Store {
+	case "mongo":
+		if c.MongoAddr == "" {
+			complain("store is mongo but no MongoDB address is set")
+		}
+	case "bolt":
+		if c.DBFile == "" {
+			complain("store is bolt but no database file is set")
+		}
+	case "memory":
+	default:
+		complain("unknown store %q (want mongo, memory or bolt)", c.Store)
+	}
+
+	if c.PublicKey == "" && c.KeyDir == "" {
+		complain("no public key or key directory is set")
+	}
+	if c.PublicKey != "" {
+		if info, err := os.Stat(c.PublicKey); err != nil {
+			complain("public key: %v", err)
+		} else if info.IsDir() {
+			complain("public key %s is a directory", c.PublicKey)
+		}
+	}
+	if c.KeyDir != "" {
+		if info, err := os.Stat(c.KeyDir); err != nil {
+			complain("key directory: %v", err)
+		} else if !info.IsDir() {
+			complain("key directory %s is not a directory", c.KeyDir)
+		}
+	}
+	switch c.ImageStorage {
+	case "local":
+		if info, err := os.Stat(c.ImageDir); err != nil {
+			complain("image directory: %v", err)
+		} else if !info.IsDir() {
+			complain("image directory %s is not a directory", c.ImageDir)
+		}
+
+		if u, err := url.Parse(c.ImageURL); err != nil || !u.IsAbs() {
+			complain("image URL %q is not an absolute URL", c.ImageURL)
+		} else if !strings.HasSuffix(c.ImageURL, "/") {
+			complain("image URL %q should end with a slash", c.ImageURL)
+		}
+	case "s3":
+		if u, err := url.Parse(c.S3.Endpoint); err != nil || !u.IsAbs() {
+			complain("S3 endpoint %q is not an absolute URL", c.S3.Endpoint)
+		}
+		if c.S3.Bucket == "" || c.S3.Region == "" {
+			complain("image storage is s3 but the bucket or region is missing")
+		}
+		if c.S3.AccessKey == "" || c.S3.SecretKey == "" {
+			complain("image storage is s3 but the access key or secret key is missing")
+		}
+		if c.S3.PublicURL != "" && !strings.HasSuffix(c.S3.PublicURL, "/") {
+			complain("S3 public URL %q should end with a slash", c.S3.PublicURL)
+		}
+	default:
+		complain("unknown image storage %q (want local or s3)", c.ImageStorage)
+	}
+	// (The image directory has been checked already if it's the default)
+	if c.UploadDir != "" || c.ImageStorage != "local" {
+		if info, err := os.Stat(c.uploadDir()); err != nil {
+			complain("upload directory: %v (set -upload-dir)", err)
+		} else if !info.IsDir() {
+			complain("upload directory %s is not a directory", c.uploadDir())
+		}
+	}
+	if c.MaxImageSize <= 0 {
+		complain("max image size must be positive")
+	}
+	if c.ThumbSize <= 0 {
+		complain("thumbnail size must be positive")
+	}
+	if _, err := c.imageWidths(); err != nil {
+		complain("image widths: %v", err)
+	}
+	if u, err := url.Parse(c.Feed.Link); err != nil || !u.IsAbs() {
+		complain("feed link %q is not an absolute URL", c.Feed.Link)
+	}
+	if c.CORSOrigin == "" {
+		complain("CORS origin is empty (use * to allow everyone)")
+	}
+	if _, err := c.trustedProxies(); err != nil {
+		complain("trusted proxies: %v", err)
+	}
+
+	if len(problems) > 0 {
+		return errors.New("bad configuration:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// uploadDir is where uploads are spooled while they're checked. The
+//	image directory is the default, since it's there and writable
+//	wherever local storage is; our image has no /tmp.
+func (c Config) uploadDir() string {
+	if c.UploadDir != "" {
+		return c.UploadDir
+	}
+	if c.ImageStorage == "local" {
+		return c.ImageDir
+	}
+	return os.TempDir()
+}
+
+// imageWidths parses the list of widths resized images are made at.
+func (c Config) imageWidths() ([]int, error) {
+	var widths []int
+	for _, field := range strings.Split(c.ImageWidths, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		w, err := strconv.Atoi(field)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("%q is not a width in pixels", field)
+		}
+		widths = append(widths, w)
+	}
+	return widths, nil
+}
+
+// trustedProxies parses the list of reverse proxies we believe about
+//	where requests came from. A lone address is a range of one.
+func (c Config) trustedProxies() ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, field := range strings.Split(c.TrustedProxies, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if ip := net.ParseIP(field); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", field)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// boolFlag is a boolean flag that remembers its raw value so it can be
+//	applied on top of the file and environment like the others.
+type boolFlag struct {
+	value *string
+}
+
+func (b boolFlag) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return *b.value
+}
+
+func (b boolFlag) Set(s string) error {
+	if _, err := strconv.ParseBool(s); err != nil {
+		return err
+	}
+	*b.value = s
+	return nil
+}
+
+func (b boolFlag) IsBoolFlag() bool { return true }
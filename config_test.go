@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := filepath.Join(dir, "public.pem")
+	if err := ioutil.WriteFile(key, []byte("key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config.json")
+	json := `{"listen": ":9000", "store": "bolt", "imagedir": "` + dir + `", "publickey": "` + key + `",
+		"feed": {"title": "From the file"}}`
+	if err := ioutil.WriteFile(file, []byte(json), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("API_LISTEN", ":9001")
+	os.Setenv("API_DEV", "true")
+	defer os.Unsetenv("API_LISTEN")
+	defer os.Unsetenv("API_DEV")
+
+	cfg, err := LoadConfig([]string{"-config", file, "-store", "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":9001" {
+		t.Errorf("environment should override the file, got listen %q", cfg.Listen)
+	}
+	if cfg.Store != "memory" {
+		t.Errorf("flags should override the file, got store %q", cfg.Store)
+	}
+	if cfg.Feed.Title != "From the file" || cfg.Feed.Author != "Nico Courts" {
+		t.Errorf("feed settings not merged with defaults: %+v", cfg.Feed)
+	}
+	if !cfg.Dev || cfg.MongoAddr != "localhost:27017" {
+		t.Errorf("dev mode should use a local MongoDB, got %q", cfg.MongoAddr)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Store = "postgres"
+	cfg.ImageURL = "/img"
+	cfg.PublicKey = "/does/not/exist.pem"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"postgres", "public key", "image URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should mention %q: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// stripMetadata removes EXIF, XMP, IPTC, comments and text metadata
+//	(which is where cameras and phones put GPS coordinates, serial
+//	numbers and the like) from an image without touching the pixels. A
+//	JPEG keeps its orientation, since without it phone photos come out
+//	sideways. A JPEG or PNG we can't pick apart is made again from its
+//	pixels instead; any other image we can't make sense of is refused
+//	with an *uploadError, since we can't vouch for what's in it.
+func stripMetadata(data []byte, mimeType string) ([]byte, error) {
+	var out []byte
+	ok := false
+	switch mimeType {
+	case "image/jpeg":
+		if out, ok = stripJPEG(data); !ok {
+			return reencode(data, mimeType)
+		}
+	case "image/png":
+		if out, ok = stripPNG(data); !ok {
+			return reencode(data, mimeType)
+		}
+	case "image/webp":
+		out, ok = stripWebP(data)
+	case "image/gif":
+		out, ok = stripGIF(data)
+	}
+	if !ok {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "couldn't read the image's metadata"}
+	}
+	return out, nil
+}
+
+// reencode makes a JPEG or PNG again from its pixels, which leaves
+//	behind anything else the file had in it. A JPEG's orientation is
+//	applied to the pixels, since the new file has nowhere to keep it.
+func reencode(data []byte, mimeType string) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "couldn't read the image's metadata"}
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "couldn't read the image's metadata"}
+	}
+
+	var buf bytes.Buffer
+	if mimeType == "image/jpeg" {
+		pixels := image.NewNRGBA(src.Bounds())
+		draw.Draw(pixels, pixels.Bounds(), src, src.Bounds().Min, draw.Src)
+		err = jpeg.Encode(&buf, orient(pixels, jpegOrientation(data)), &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stripJPEG drops comments and every application segment from a JPEG
+//	except the ones decoders need: the JFIF header (APP0), the colour
+//	profile (APP2) and Adobe's colour transform (APP14). That takes
+//	EXIF and XMP (APP1), IPTC (APP13) and whatever cameras keep in the
+//	rest. If the EXIF data had an orientation, a minimal EXIF segment
+//	holding only that is put back.
+func stripJPEG(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, false
+	}
+
+	orientation := 1
+	var out bytes.Buffer
+	out.Write(data[:2])
+	rest := data[2:]
+	for {
+		if len(rest) < 4 || rest[0] != 0xff {
+			return nil, false
+		}
+		marker := rest[1]
+
+		// Everything from the start of the scan on is image data
+		if marker == 0xda {
+			if orientation != 1 {
+				insertOrientation(&out, orientation)
+			}
+			out.Write(rest)
+			return out.Bytes(), true
+		}
+
+		length := int(binary.BigEndian.Uint16(rest[2:4])) + 2
+		if length < 4 || length > len(rest) {
+			return nil, false
+		}
+		segment := rest[:length]
+		rest = rest[length:]
+
+		switch {
+		case marker == 0xe1:
+			if o := exifOrientation(segment[4:]); o != 0 {
+				orientation = o
+			}
+		case marker == 0xe0 && bytes.HasPrefix(segment[4:], []byte("JFIF\x00")),
+			marker == 0xe2 && bytes.HasPrefix(segment[4:], []byte("ICC_PROFILE\x00")),
+			marker == 0xee:
+			out.Write(segment)
+		case marker >= 0xe0 && marker <= 0xef, marker == 0xfe:
+			// Other application segments and comments
+		default:
+			out.Write(segment)
+		}
+	}
+}
+
+// insertOrientation adds an EXIF segment holding nothing but the given
+//	orientation. It goes after the JFIF header if there is one, since
+//	that has to come first.
+func insertOrientation(out *bytes.Buffer, orientation int) {
+	segment := []byte{
+		0xff, 0xe1, 0x00, 0x22,
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0x00, 0x2a, 0x00, 0x00, 0x00, 0x08, // TIFF header, IFD at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // orientation, 1 SHORT
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+
+	data := out.Bytes()
+	at := 2
+	if len(data) >= 6 && data[2] == 0xff && data[3] == 0xe0 {
+		at += int(binary.BigEndian.Uint16(data[4:6])) + 2
+	}
+	rest := append([]byte{}, data[at:]...)
+	out.Truncate(at)
+	out.Write(segment)
+	out.Write(rest)
+}
+
+// exifOrientation finds the orientation tag in the body of an APP1
+//	segment, or returns 0 if there isn't one.
+func exifOrientation(app1 []byte) int {
+	if !bytes.HasPrefix(app1, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := app1[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 0
+			}
+			return o
+		}
+	}
+	return 0
+}
+
+// pngMetadata lists the PNG chunks that carry metadata rather than pixels.
+var pngMetadata = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNG drops the metadata chunks from a PNG.
+func stripPNG(data []byte) ([]byte, bool) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	out.WriteString(signature)
+	rest := data[len(signature):]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint32(rest[:4])) + 12
+		if length < 12 || length > len(rest) {
+			return nil, false
+		}
+		if !pngMetadata[string(rest[4:8])] {
+			out.Write(rest[:length])
+		}
+		rest = rest[length:]
+	}
+	return out.Bytes(), true
+}
+
+// WebP's VP8X header flags for the metadata chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks from a WebP, and clears the
+//	flags in its VP8X header that say they're there.
+func stripWebP(data []byte) ([]byte, bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+	size := int(binary.LittleEndian.Uint32(data[4:8])) + 8
+	if size < 12 || size > len(data) {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:12])
+	rest := data[12:size]
+	for len(rest) > 0 {
+		if len(rest) < 8 {
+			return nil, false
+		}
+		fourCC := string(rest[:4])
+		length := int(binary.LittleEndian.Uint32(rest[4:8])) + 8
+		if length < 8 || length > len(rest) {
+			return nil, false
+		}
+		chunk := rest[:length]
+		// Chunks are padded to an even length
+		if length%2 == 1 && length < len(rest) {
+			length++
+		}
+		rest = rest[length:]
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if len(chunk) < 9 {
+				return nil, false
+			}
+			chunk = append([]byte{}, chunk...)
+			chunk[8] &^= webpFlagEXIF | webpFlagXMP
+		}
+		out.Write(chunk)
+		if len(chunk)%2 == 1 {
+			out.WriteByte(0)
+		}
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, true
+}
+
+// gifAnimation lists the application extensions a GIF needs to play
+//	properly. Any other (XMP among them) is metadata.
+var gifAnimation = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+}
+
+// stripGIF drops the comments and the application extensions other than
+//	the animation ones from a GIF.
+func stripGIF(data []byte) ([]byte, bool) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return nil, false
+	}
+	header := 13
+	if data[10]&0x80 != 0 {
+		header += 3 << (uint(data[10]&0x07) + 1)
+	}
+	if header > len(data) {
+		return nil, false
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:header])
+	rest := data[header:]
+	for len(rest) > 0 {
+		start := rest
+		switch rest[0] {
+		case 0x3b:
+			// The trailer; anything after it is dropped
+			out.WriteByte(0x3b)
+			return out.Bytes(), true
+		case 0x21:
+			if len(rest) < 2 {
+				return nil, false
+			}
+			label := rest[1]
+			body, ok := skipGIFSubBlocks(rest[2:])
+			if !ok {
+				return nil, false
+			}
+			rest = body
+			block := start[:len(start)-len(rest)]
+			if label == 0xfe {
+				continue
+			}
+			if label == 0xff && (len(block) < 14 || block[2] != 11 || !gifAnimation[string(block[3:14])]) {
+				continue
+			}
+			out.Write(block)
+		case 0x2c:
+			if len(rest) < 11 {
+				return nil, false
+			}
+			n := 10
+			if rest[9]&0x80 != 0 {
+				n += 3 << (uint(rest[9]&0x07) + 1)
+			}
+			// The LZW code size, then the image data
+			if n+1 > len(rest) {
+				return nil, false
+			}
+			body, ok := skipGIFSubBlocks(rest[n+1:])
+			if !ok {
+				return nil, false
+			}
+			rest = body
+			out.Write(start[:len(start)-len(rest)])
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// skipGIFSubBlocks returns what comes after a run of GIF sub-blocks,
+//	which ends with an empty one.
+func skipGIFSubBlocks(data []byte) ([]byte, bool) {
+	for {
+		if len(data) == 0 {
+			return nil, false
+		}
+		n := int(data[0])
+		if n == 0 {
+			return data[1:], true
+		}
+		if n+1 > len(data) {
+			return nil, false
+		}
+		data = data[n+1:]
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/NicoCourts/API-server
+
+go 1.26.0
+
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/OneOfOne/xxhash v1.2.8
+	github.com/gorilla/feeds v1.2.0
+	github.com/gorilla/mux v1.8.1
+	github.com/yuin/goldmark v1.8.6
+	go.etcd.io/bbolt v1.5.0
+	golang.org/x/image v0.46.0
+	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+)
+
+require (
+	golang.org/x/sys v0.48.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -1,15 +1,13 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -21,10 +19,22 @@ import (
 )
 import b64 "encoding/base64"
 
-var origin string
+// ErrorResponse is the body sent back when a request is refused.
+type ErrorResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// WriteError sends the given status code along with an ErrorResponse.
+func WriteError(w http.ResponseWriter, status int, msg string) {
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(status)
 
-func init() {
-	origin = "*"
+	if err := json.NewEncoder(w).Encode(ErrorResponse{status, msg}); err != nil {
+		log.Print(err)
+	}
 }
 
 // Index just welcomes you
@@ -33,49 +43,64 @@ func Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "Visit <a href='https://api.nicocourts.com/posts'>this link</a> for the post list.")
 }
 
-// PostIndex returns a JSON list of all posts
+// PostIndex returns a JSON list of visible posts, a page at a time (see
+//	parsePostQuery for the options).
 func PostIndex(w http.ResponseWriter, r *http.Request) {
-
-	// Responsibly declare our content type
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.WriteHeader(http.StatusOK)
-
-	if err := json.NewEncoder(w).Encode(RepoGetVisiblePosts()); err != nil {
-		panic(err)
-	}
+	listPosts(w, r, true)
 }
 
-// AllPostIndex returns a JSON list of all posts (including invisible ones)
+// AllPostIndex returns a JSON list of all posts (including invisible
+//	ones), a page at a time like PostIndex.
 func AllPostIndex(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1000000))
+	listPosts(w, r, false)
+}
 
+// TagIndex lists every tag on a visible post, with how many posts have
+//	it, most used first.
+func TagIndex(w http.ResponseWriter, r *http.Request) {
+	tags, err := RepoTagCounts()
 	if err != nil {
-		panic(err)
-	}
-	if err := r.Body.Close(); err != nil {
-		panic(err)
-	}
-
-	type Nothing struct{}
-	var nada Nothing
-
-	if err := Verify(body, &nada); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
 		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't count tags")
 		return
 	}
 
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(tags); err != nil {
+		log.Print(err)
+	}
+}
 
-	if err := json.NewEncoder(w).Encode(RepoGetAllPosts()); err != nil {
-		panic(err)
+// TagPosts lists the visible posts with a tag, a page at a time like
+//	PostIndex.
+func TagPosts(w http.ResponseWriter, r *http.Request) {
+	listPosts(w, r, true)
+}
+
+// listPosts sends the page of posts asked for in the query string, only
+//	those with the tag in the URL if there is one.
+func listPosts(w http.ResponseWriter, r *http.Request, visibleOnly bool) {
+	q, err := parsePostQuery(r.URL.Query())
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
 	}
+	if tag, ok := mux.Vars(r)["tag"]; ok {
+		if q.Tag, err = normalizeTag(tag); err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	posts, next, err := RepoFindPosts(visibleOnly, q)
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't list posts")
+		return
+	}
+	writePostPage(w, r, posts, next, q)
 }
 
 // PostShow returns the details of a specific post
@@ -84,10 +109,10 @@ func PostShow(w http.ResponseWriter, r *http.Request) {
 	postID := vars["postID"]
 
 	p := RepoGetPost(postID)
-	if (p != Post{}) {
+	if p.ID != 0 {
 		// Responsibly declare our content type
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(p); err != nil {
 			panic("Error with JSON encoding")
@@ -101,21 +126,31 @@ func PostShow(w http.ResponseWriter, r *http.Request) {
 //	the form {"title":"t", "body":"b", "isshort":T/F} where t and b are
 //	treated as html that has been escaped via html.EscapeString().
 func PostCreate(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1000000))
-
+	var input Input
+	if err := SignedPayload(r, &input); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse post")
+		return
+	}
+	tags, err := normalizeTags(input.Tags)
 	if err != nil {
-		panic(err)
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	if err := r.Body.Close(); err != nil {
-		panic(err)
+	if err := checkSchedule(input.PublishAt, input.UnpublishAt); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
 	}
-
-	// Refactoring to maximize code reuse
-	var input Input
-	if err := Verify(body, &input); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
+	status := input.Status
+	if status == "" {
+		status = StatusDraft
+	}
+	if !validStatus(status) {
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("unknown status %q", status))
+		return
+	}
+	if err := input.renderBody(); err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't render the Markdown")
 		return
 	}
 
@@ -126,10 +161,7 @@ func PostCreate(w http.ResponseWriter, r *http.Request) {
 	if len(urlTitle) > 35 {
 		urlTitle = urlTitle[:35]
 	}
-	// change urltitle if it already exists
-	for RepoURLTitleExists(urlTitle) {
-		urlTitle += "0"
-	}
+	// (the store changes it if it already exists)
 
 	// We've confirmed authenticity at this point. Prepare post for insertion.
 	post := Post{
@@ -137,45 +169,61 @@ func PostCreate(w http.ResponseWriter, r *http.Request) {
 		URLTitle: urlTitle,
 		Body:     input.Body,
 		Markdown: input.Markdown,
-		Visible:  true,
+		Tags:     tags,
 		Date:     time.Now(),
 		Updated:  time.Now(),
+
+		PublishAt:   input.PublishAt,
+		UnpublishAt: input.UnpublishAt,
 	}
+	setStatus(&post, status)
 
-	p := RepoCreatePost(post)
-	if err := json.NewEncoder(w).Encode(p); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		panic(err)
+	p, err := RepoCreatePost(post, SignerID(r))
+	if err == ErrExists {
+		WriteError(w, http.StatusConflict, "a post with the same ID was just created")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't create post")
+		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		log.Print(err)
+	}
 }
 
 // PostUpdate updates the title and content of a currently-existing post.
 func PostUpdate(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1000000))
-
-	if err != nil {
-		panic(err)
-	}
-	if err := r.Body.Close(); err != nil {
-		panic(err)
-	}
 	postID := mux.Vars(r)["postID"]
 
 	var input Input
-	if err := Verify(body, &input); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
+	if err := SignedPayload(r, &input); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse post")
+		return
+	}
+	var err error
+	if input.Tags, err = normalizeTags(input.Tags); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := input.renderBody(); err != nil {
 		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't render the Markdown")
 		return
 	}
 
-	if err := RepoUpdatePost(postID, input); err != nil {
+	err = RepoUpdatePost(postID, input, SignerID(r))
+	if err == ErrBadSchedule {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
 		log.Print("Problem Updating Post")
 		log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -183,31 +231,145 @@ func PostUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 	//Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
 }
 
-// PostToggle toggles a post's visibility
-func PostToggle(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1000000))
+// revisionVars reads the post ID and, if the route has one, the revision
+//	number from the URL. Anything that isn't a number can't match a
+//	post or revision, so it answers 404 itself and returns false.
+func revisionVars(w http.ResponseWriter, r *http.Request) (uint32, int, bool) {
+	vars := mux.Vars(r)
+	postID, err := strconv.ParseUint(vars["postID"], 10, 32)
+	if err != nil {
+		WriteError(w, http.StatusNotFound, "post not found")
+		return 0, 0, false
+	}
+	number := 0
+	if s, ok := vars["revision"]; ok {
+		if number, err = strconv.Atoi(s); err != nil {
+			WriteError(w, http.StatusNotFound, "revision not found")
+			return 0, 0, false
+		}
+	}
+	return uint32(postID), number, true
+}
+
+// writeJSON sends v with a 200.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(err)
+	}
+}
 
+// PostRevisions lists a post's revisions, oldest first, without their
+//	content.
+func PostRevisions(w http.ResponseWriter, r *http.Request) {
+	postID, _, ok := revisionVars(w, r)
+	if !ok {
+		return
+	}
+	revs, err := RepoPostRevisions(postID)
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "post not found")
+		return
+	}
 	if err != nil {
-		panic(err)
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't list revisions")
+		return
 	}
-	if err := r.Body.Close(); err != nil {
-		panic(err)
+
+	summaries := []RevisionSummary{}
+	for _, rev := range revs {
+		summaries = append(summaries, rev.Summary())
 	}
-	postID := mux.Vars(r)["postID"]
+	writeJSON(w, summaries)
+}
 
-	type Nothing struct{}
-	var nada Nothing
-	if err := Verify(body, &nada); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
+// PostRevision returns one revision of a post, content and all.
+func PostRevision(w http.ResponseWriter, r *http.Request) {
+	postID, number, ok := revisionVars(w, r)
+	if !ok {
+		return
+	}
+	rev, err := RepoGetRevision(postID, number)
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "revision not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't look up revision")
+		return
+	}
+	writeJSON(w, rev)
+}
+
+// PostDiff compares the Markdown of the revisions of a post given by the
+//	from and to parameters, as a unified diff.
+func PostDiff(w http.ResponseWriter, r *http.Request) {
+	postID, _, ok := revisionVars(w, r)
+	if !ok {
+		return
+	}
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "from must be a revision number")
+		return
+	}
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, "to must be a revision number")
 		return
 	}
 
+	diff, err := RepoDiffRevisions(postID, from, to)
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "revision not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't compare revisions")
+		return
+	}
+	writeJSON(w, struct {
+		From int    `json:"from"`
+		To   int    `json:"to"`
+		Diff string `json:"diff"`
+	}{from, to, diff})
+}
+
+// PostRestore rolls a post back to one of its revisions, and returns the
+//	post as it is now.
+func PostRestore(w http.ResponseWriter, r *http.Request) {
+	postID, number, ok := revisionVars(w, r)
+	if !ok {
+		return
+	}
+	post, err := RepoRestoreRevision(postID, number, SignerID(r))
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "post or revision not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't restore revision")
+		return
+	}
+	log.Printf("Post %d restored to revision %d by key %s", postID, number, SignerID(r))
+	writeJSON(w, post)
+}
+
+// PostToggle toggles a post's visibility
+func PostToggle(w http.ResponseWriter, r *http.Request) {
+	postID := mux.Vars(r)["postID"]
+
 	if err := RepoTogglePost(postID); err != nil {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		log.Print(err)
@@ -217,177 +379,526 @@ func PostToggle(w http.ResponseWriter, r *http.Request) {
 	}
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
 }
 
-// ImageDelete deletes the post with the given ID
-func ImageDelete(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1000000))
-
-	if err != nil {
-		panic(err)
+// PostStatus moves a post to another state. Moves that aren't allowed
+//	from the state the post is in get a 409.
+func PostStatus(w http.ResponseWriter, r *http.Request) {
+	var change StatusChange
+	if err := SignedPayload(r, &change); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse status change")
+		return
 	}
-	if err := r.Body.Close(); err != nil {
-		panic(err)
+	if !validStatus(change.Status) {
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("unknown status %q", change.Status))
+		return
+	}
+
+	post, err := RepoSetPostStatus(mux.Vars(r)["postID"], change.Status)
+	switch err {
+	case nil:
+		writeJSON(w, post)
+	case ErrNotFound:
+		WriteError(w, http.StatusNotFound, "post not found")
+	case ErrBadTransition:
+		WriteError(w, http.StatusConflict, err.Error())
+	default:
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't change the post's status")
 	}
+}
 
-	type PicData struct {
-		dateString string
+// SearchPosts searches the visible posts for the q parameter (see
+//	parseSearchQuery), best match first, a page at a time: limit says
+//	how many results and offset where to start. A Link header points
+//	at the next page if there is one.
+func SearchPosts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, offset := 20, 0
+	var err error
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageSize {
+			WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
 	}
-	var data PicData
-	if err := Verify(body, &data); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
+	if s := query.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			WriteError(w, http.StatusBadRequest, "bad offset")
+			return
+		}
+	}
+
+	results, total, err := RepoSearchPosts(query.Get("q"), offset, limit)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Get the data to work with
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Total-Count")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if offset+limit < total {
+		u := *r.URL
+		query.Set("offset", strconv.Itoa(offset+limit))
+		u.RawQuery = query.Encode()
+		w.Header().Set("Link", "<"+u.RequestURI()+`>; rel="next"`)
+	}
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Print(err)
+	}
+}
 
-	img, err := RepoGetImage(data.dateString)
+// ImageShow returns the details of a single image
+func ImageShow(w http.ResponseWriter, r *http.Request) {
+	img, err := RepoGetImage(mux.Vars(r)["imageID"])
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "image not found")
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't look up image")
 		return
 	}
 
-	// Everything is kosher -- delete the file.
-	//f err := os.Remove("/etc/img/" + filename); err != nil {
-	if err := os.Remove("/home/omfg_lag/img/" + img.Filename); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(img); err != nil {
 		log.Print(err)
+	}
+}
+
+// ImageUpdate changes an image's title, alt text, caption or credit. The
+//	signed payload is an ImageEdit, and only the fields it has change.
+func ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	var edit ImageEdit
+	if err := SignedPayload(r, &edit); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse image details")
 		return
 	}
 
-	//Also remove the entry in the DB
-	if err := RepoDeleteImage(data.dateString); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	img, err := RepoGetImage(mux.Vars(r)["imageID"])
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	if err != nil {
 		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't look up image")
+		return
+	}
+	if err := edit.Apply(&img); err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := RepoSaveImage(img); err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't update image")
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(img); err != nil {
+		log.Print(err)
+	}
 }
 
-// UploadImage takes in some multipart form info representing an image
-//	and returns metadata for the resource if the upload is successful.
-func UploadImage(w http.ResponseWriter, r *http.Request) {
-	// Don't allow people to flood our API with data
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 10000000))
+// ImageDelete deletes the image with the given ID, files and all. Images
+//	that posts are still using are only deleted if the signed payload is
+//	{"force": true}.
+func ImageDelete(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Force bool `json:"force"`
+	}
+	if err := SignedPayload(r, &input); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse request")
+		return
+	}
+
+	id := mux.Vars(r)["imageID"]
+	refs, err := RepoImageReferences()
 	if err != nil {
 		log.Print(err)
-		log.Print("Error parsing input")
+		WriteError(w, http.StatusInternalServerError, "couldn't check where the image is used")
 		return
 	}
+	if posts := refs[id]; len(posts) > 0 {
+		var ids []string
+		for _, p := range posts {
+			ids = append(ids, strconv.Itoa(int(p)))
+		}
+		if !input.Force {
+			WriteError(w, http.StatusConflict, "image is used by posts "+strings.Join(ids, ", "))
+			return
+		}
+		log.Printf("Key %s is deleting image %s, which posts %s still use", SignerID(r), id, strings.Join(ids, ", "))
+	}
 
+	err = RepoDeleteImage(id)
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "image not found")
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't delete image")
+		return
+	}
+	log.Printf("Image %s deleted by key %s", id, SignerID(r))
+
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UploadImage takes in an image and returns metadata for the resource if
+//	the upload is successful. The image can come as multipart/form-data
+//	(in a file field called "image", with the signature in the
+//	X-Signature header) or, as older clients send it, base64-encoded in
+//	a JSON object alongside the signature.
+func UploadImage(w http.ResponseWriter, r *http.Request) {
+	var manifest ImageManifest
+	if err := SignedPayload(r, &manifest); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse image manifest")
+		return
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		parts, err := r.MultipartReader()
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "couldn't parse upload")
+			return
+		}
+		for {
+			part, err := parts.NextPart()
+			if err == io.EOF {
+				WriteError(w, http.StatusBadRequest, "upload has no image field")
+				return
+			}
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "couldn't parse upload")
+				return
+			}
+			if part.FormName() == "image" {
+				img, existing, err := saveUpload(part, part.FileName(), manifest)
+				writeUpload(w, r, img, existing, err)
+				return
+			}
+		}
+	}
+
+	// The signature rides along with the image in the same JSON object
+	//	and covers an ImageManifest describing the image.
 	type ImageUpload struct {
 		Img      string
 		Filename string
-		Sig      string
-		Nonce    string
 	}
 	var input ImageUpload
-	if err := json.Unmarshal(body, &input); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		log.Print("Error unmarshalling image")
 		log.Print(err)
+		WriteError(w, http.StatusBadRequest, "couldn't parse upload")
 		return
 	}
-	// Create new blob omitting the image data (since we are not signing it)
-	blob, _ := json.Marshal(struct {
-		Payload string
-		Sig     string
-		Nonce   string
-	}{
-		"",
-		input.Sig,
-		input.Nonce,
-	})
+	img, existing, err := saveUpload(b64.NewDecoder(b64.StdEncoding, strings.NewReader(input.Img)), input.Filename, manifest)
+	writeUpload(w, r, img, existing, err)
+}
 
-	type Nothing struct{}
-	var nada Nothing
-	if err := Verify(blob, &nada); err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		log.Print("Unauthorized Access Attempt")
-		log.Print(err)
+// UploadImageFile takes the raw bytes of an image as the body of a PUT,
+//	with the signature in the X-Signature header.
+func UploadImageFile(w http.ResponseWriter, r *http.Request) {
+	var manifest ImageManifest
+	if err := SignedPayload(r, &manifest); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse image manifest")
 		return
 	}
 
-	// Get new filename
-	imgBytes, _ := b64.StdEncoding.DecodeString(input.Img)
-	checkBytes := md5.Sum(imgBytes)
-	checksum := checkBytes[:]
-
-	name := hex.EncodeToString(checksum) + filepath.Ext(input.Filename)
-	log.Print("Name: " + name)
+	img, existing, err := saveUpload(r.Body, mux.Vars(r)["filename"], manifest)
+	writeUpload(w, r, img, existing, err)
+}
 
-	// Write the file to disk
-	f, err := os.OpenFile("/etc/img/"+name, os.O_WRONLY|os.O_CREATE, 0666)
+// writeUpload answers an image upload with the new Image (or the one we
+//	already had, with a 200 rather than a 201), or with why it was turned
+//	down.
+func writeUpload(w http.ResponseWriter, r *http.Request, img Image, existing bool, err error) {
+	if uerr, ok := err.(*uploadError); ok {
+		log.Printf("Rejected upload from key %s: %v", SignerID(r), err)
+		WriteError(w, uerr.status, uerr.msg)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't save image")
 		return
 	}
 
-	defer f.Close()
-	f.Write(imgBytes)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	if existing {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if err := json.NewEncoder(w).Encode(img); err != nil {
+		log.Print(err)
+	}
+}
+
+// GetImageList returns a list of currently-available images along with
+//	some metadata, newest first. It can be narrowed down by title (any
+//	part of it, ignoring case) and by upload date with the since and
+//	until parameters, which take a date or an RFC 3339 time.
+func GetImageList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := ImageFilter{Title: query.Get("title")}
+	var err error
+	if filter.After, err = parseDateParam(query.Get("since"), false); err != nil {
+		WriteError(w, http.StatusBadRequest, "bad since date")
+		return
+	}
+	if filter.Before, err = parseDateParam(query.Get("until"), true); err != nil {
+		WriteError(w, http.StatusBadRequest, "bad until date")
+		return
+	}
 
-	image := RepoAddImage(hex.EncodeToString(checksum), filepath.Ext(input.Filename), (input.Filename)[0:len(input.Filename)-len(filepath.Ext(input.Filename))])
-	err = json.NewEncoder(w).Encode(image)
+	images, err := RepoFindImages(filter)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't list images")
 		return
 	}
-	// Great!
-	w.WriteHeader(http.StatusCreated)
+
+	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(images); err != nil {
+		panic(err)
+	}
 }
 
-// GetImageList returns a list of currently-available images along with some metadata.
-func GetImageList(w http.ResponseWriter, r *http.Request) {
+// parseDateParam reads a query parameter holding either an RFC 3339 time
+//	or just a date. A bare date means the start of that day (UTC), or
+//	the end of it if endOfDay is set. An empty parameter is the zero time.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// ImageOrphans lists the images no post uses and the stored files that
+//	don't belong to any image, and deletes them all if the signed payload
+//	is {"purge": true}.
+func ImageOrphans(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Purge bool `json:"purge"`
+	}
+	if err := SignedPayload(r, &input); err != nil {
+		WriteError(w, http.StatusBadRequest, "couldn't parse request")
+		return
+	}
+
+	report, err := RepoFindOrphans()
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't look for orphans")
+		return
+	}
+	if input.Purge {
+		log.Printf("Key %s is purging %d orphaned images and %d orphaned files", SignerID(r), len(report.Images), len(report.Files))
+		RepoPurgeOrphans(&report)
+	}
+
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Print(err)
+	}
+}
 
-	if err := json.NewEncoder(w).Encode(RepoGetImageList()); err != nil {
-		panic(err)
+// ServeImage serves an image (or one of its variants) from the image
+//	storage. Image files never change once they're written, since
+//	they're named after their contents, so they can be cached forever;
+//	the name doubles as the ETag. http.ServeContent takes care of
+//	conditional and range requests.
+func ServeImage(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["filename"]
+
+	f, err := imageStorage.Get(name)
+	if err == ErrNotFound {
+		WriteError(w, http.StatusNotFound, "image not found")
+		return
 	}
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusBadGateway, "couldn't fetch image")
+		return
+	}
+	defer f.Close()
+
+	ext := filepath.Ext(name)
+	for mimeType, e := range imageTypes {
+		if e == ext {
+			w.Header().Set("Content-Type", mimeType)
+		}
+	}
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(name, ext)+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	http.ServeContent(w, r, name, f.ModTime(), f)
 }
 
-// ReadNonce prints out the current nonce to use for authentication
+// ReadNonce hands out a fresh nonce for the client to sign. Every client
+//	gets its own, so concurrent editors don't trip over each other.
 func ReadNonce(w http.ResponseWriter, r *http.Request) {
+	nonce, err := challenges.Issue(clientAddr(r))
+	switch err {
+	case nil:
+	case ErrTooManyForClient:
+		w.Header().Set("Retry-After", "60")
+		WriteError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case ErrChallengesFull:
+		w.Header().Set("Retry-After", "60")
+		WriteError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	default:
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 
 	w.WriteHeader(http.StatusOK)
 
-	nonce := CurrentNonce()
-
 	if err := json.NewEncoder(w).Encode(nonce); err != nil {
 		panic(err)
 	}
 }
 
-// NonceUpdate just churns the nonce. This is useful if the client
-//	notices the nonce is near expiring and would rather not risk it.
-//	Since generating pseudorandom noise can be expensive, require
-//	nonce to be at least 10 minutes old to prevent DDOS attacks.
+// NonceUpdate swaps a nonce for a new one. This is useful if the client
+//	notices the nonce is near expiring and would rather not risk it. The
+//	old nonce is passed as ?old= (in URL-safe or standard base64) and
+//	goes away in the swap. Since generating pseudorandom noise can be
+//	expensive, only nonces at least 10 minutes old can be swapped.
 func NonceUpdate(w http.ResponseWriter, r *http.Request) {
-	if NonceIsOlderThan(10 * time.Minute) {
-		UpdateNonce()
-		w.WriteHeader(http.StatusAccepted)
-	} else {
+	oldStr := r.URL.Query().Get("old")
+	old, err := b64.URLEncoding.DecodeString(oldStr)
+	if err != nil {
+		old, err = b64.StdEncoding.DecodeString(oldStr)
+	}
+	if err != nil || len(old) == 0 {
+		WriteError(w, http.StatusBadRequest, "old must be the nonce to swap")
+		return
+	}
+
+	nonce, err := challenges.Renew(old)
+	switch err {
+	case nil:
+	case ErrUnknownChallenge, ErrRenewTooSoon:
 		// Sorry, chum
-		w.WriteHeader(http.StatusForbidden)
+		WriteError(w, http.StatusForbidden, err.Error())
+		return
+	default:
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusAccepted)
+
+	if err := json.NewEncoder(w).Encode(nonce); err != nil {
+		panic(err)
+	}
+}
+
+// clientAddr returns the address a request came from, without its port,
+//	to tell clients apart by. Requests from one of the -trusted-proxies
+//	are taken to come from the last address in X-Forwarded-For that
+//	isn't another of our proxies (anything before it could have been
+//	made up by the client), or failing that from X-Real-IP.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies, _ := config.trustedProxies()
+	if !inNetworks(host, proxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		if !inNetworks(addr, proxies) {
+			return addr
+		}
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return host
+}
+
+// inNetworks reports whether addr is an IP address in one of networks.
+func inNetworks(addr string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DBStats reports on the storage backend's connection pool.
+func DBStats(w http.ResponseWriter, r *http.Request) {
+	stats, ok := StoreStats()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		panic(err)
 	}
 }
 
@@ -398,7 +909,7 @@ func NonceUpdate(w http.ResponseWriter, r *http.Request) {
 func GetRSVP(w http.ResponseWriter, r *http.Request) {
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 
 	vars := mux.Vars(r)
 	rescode := vars["rescode"]
@@ -419,7 +930,7 @@ func GetRSVP(w http.ResponseWriter, r *http.Request) {
 func UpdateRSVP(w http.ResponseWriter, r *http.Request) {
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 
 	vars := mux.Vars(r)
 	rescode := vars["rescode"]
@@ -469,21 +980,54 @@ func UpdateRSVP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// GetRSSFeed parses the current (visible) post list as an RSS feed for syndication.
+// GetRSSFeed parses the current (public) post list as an RSS feed for syndication.
 func GetRSSFeed(w http.ResponseWriter, r *http.Request) {
+	posts, err := RepoGetVisiblePosts()
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't list posts")
+		return
+	}
+	writeFeed(w, config.Feed.Title, posts)
+}
+
+// GetTagFeed is the RSS feed for the posts with one tag.
+func GetTagFeed(w http.ResponseWriter, r *http.Request) {
+	tag, err := normalizeTag(mux.Vars(r)["tag"])
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	visible, err := RepoGetVisiblePosts()
+	if err != nil {
+		log.Print(err)
+		WriteError(w, http.StatusInternalServerError, "couldn't list posts")
+		return
+	}
+	var posts Posts
+	for _, post := range visible {
+		if hasTag(post, tag) {
+			posts = append(posts, post)
+		}
+	}
+	writeFeed(w, config.Feed.Title+": "+tag, posts)
+}
+
+// writeFeed sends posts as an RSS feed.
+func writeFeed(w http.ResponseWriter, title string, posts Posts) {
 	feed := &feeds.Feed{
-		Title:       "NicoCourts.com blog",
-		Link:        &feeds.Link{Href: "https://nicocourts.com/blog"},
-		Description: "math, life, nature, etc",
-		Author:      &feeds.Author{Name: "Nico Courts", Email: "ncourts@uw.edu"},
+		Title:       title,
+		Link:        &feeds.Link{Href: config.Feed.Link},
+		Description: config.Feed.Description,
+		Author:      &feeds.Author{Name: config.Feed.Author, Email: config.Feed.Email},
 		Created:     time.Now(),
 	}
 	feed.Items = []*feeds.Item{}
-	posts := RepoGetVisiblePosts()
 	for _, post := range posts {
 		newItem := &feeds.Item{
 			Title:   post.Title,
-			Link:    &feeds.Link{Href: "https://nicocourts.com/blog/" + post.URLTitle},
+			Link:    &feeds.Link{Href: strings.TrimSuffix(config.Feed.Link, "/") + "/" + post.URLTitle},
 			Created: post.Updated,
 			Content: post.Body,
 		}
@@ -497,7 +1041,7 @@ func GetRSSFeed(w http.ResponseWriter, r *http.Request) {
 
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/rss+xml; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
 
 	// Write feed
@@ -508,7 +1052,7 @@ func GetRSSFeed(w http.ResponseWriter, r *http.Request) {
 func ListRSVP(w http.ResponseWriter, r *http.Request) {
 	// Responsibly declare our content type
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
 	w.WriteHeader(http.StatusOK)
 
 	if err := json.NewEncoder(w).Encode(RepoGetRSVPs()); err != nil {
@@ -1,17 +1,164 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
-// Image contains all data for one image
+// Image contains all data for one image. The ID is the hex SHA-256 of
+//	the uploaded file, and the file is named after it. Width and Height
+//	are the size the image is displayed at, and Variants are the smaller
+//	copies made when it was uploaded.
 type Image struct {
-	Filename string    `json:"filename"`
-	Title    string    `json:"title"`
-	AltText  string    `json:"alttext"`
-	URL      string    `json:"url"`
-	Date     time.Time `json:"date"`
+	ID       string         `json:"id"`
+	Filename string         `json:"filename"`
+	Title    string         `json:"title"`
+	AltText  string         `json:"alttext"`
+	Caption  string         `json:"caption,omitempty"`
+	Credit   string         `json:"credit,omitempty"`
+	URL      string         `json:"url"`
+	Date     time.Time      `json:"date"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Variants []ImageVariant `json:"variants,omitempty"`
 }
 
 // Images is just an array of posts
 type Images []Image
+
+// maxImageText is the longest title, alt text, caption or credit we'll
+//	keep for an image.
+const maxImageText = 2000
+
+// ImageEdit is the signed payload for changing an image's details. Only
+//	the fields that are present get changed.
+type ImageEdit struct {
+	Title   *string `json:"title"`
+	AltText *string `json:"alttext"`
+	Caption *string `json:"caption"`
+	Credit  *string `json:"credit"`
+}
+
+// Apply makes the edit to img. Titles and alt text can't be blank: every
+//	image needs something a screen reader can say about it.
+func (e ImageEdit) Apply(img *Image) error {
+	fields := []struct {
+		name     string
+		value    *string
+		field    *string
+		required bool
+	}{
+		{"title", e.Title, &img.Title, true},
+		{"alttext", e.AltText, &img.AltText, true},
+		{"caption", e.Caption, &img.Caption, false},
+		{"credit", e.Credit, &img.Credit, false},
+	}
+	for _, f := range fields {
+		if f.value == nil {
+			continue
+		}
+		value := strings.TrimSpace(*f.value)
+		if f.required && value == "" {
+			return fmt.Errorf("%s can't be blank", f.name)
+		}
+		if len(value) > maxImageText {
+			return fmt.Errorf("%s is longer than %d bytes", f.name, maxImageText)
+		}
+		*f.field = value
+	}
+	return nil
+}
+
+// ImageFilter picks images out of a list by title and upload date. The
+//	zero ImageFilter matches everything.
+type ImageFilter struct {
+	// Title matches images whose title contains it, ignoring case.
+	Title string
+	// After and Before bound the upload date, when they're set.
+	After  time.Time
+	Before time.Time
+}
+
+// Match reports whether img passes the filter.
+func (f ImageFilter) Match(img Image) bool {
+	if f.Title != "" && !strings.Contains(strings.ToLower(img.Title), strings.ToLower(f.Title)) {
+		return false
+	}
+	if !f.After.IsZero() && img.Date.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !img.Date.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// legacyImageID is the ID given to images stored before images had IDs:
+//	their file name without the extension, which is the MD5 of the file.
+func legacyImageID(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename))
+}
+
+// mergeImages combines several records of the same image into one: the
+//	earliest upload, with any details it's missing filled in from the
+//	others.
+func mergeImages(images []Image) Image {
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Date.Before(images[j].Date) })
+	merged := images[0]
+	for _, img := range images[1:] {
+		for _, f := range []struct{ into, from *string }{
+			{&merged.Title, &img.Title},
+			{&merged.AltText, &img.AltText},
+			{&merged.Caption, &img.Caption},
+			{&merged.Credit, &img.Credit},
+		} {
+			if *f.into == "" {
+				*f.into = *f.from
+			}
+		}
+		if merged.Width == 0 {
+			merged.Width, merged.Height = img.Width, img.Height
+		}
+		if len(merged.Variants) == 0 {
+			merged.Variants = img.Variants
+		}
+	}
+	return merged
+}
+
+// ImageManifest describes an image being uploaded. It is the payload the
+//	editor signs, so the signature covers the image itself rather than
+//	just the nonce.
+type ImageManifest struct {
+	Filename string `json:"filename"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+}
+
+// Matches checks that the uploaded file is the one described by the
+//	manifest, given its name, SHA-256 digest and size.
+func (m ImageManifest) Matches(filename string, sum []byte, size int64) error {
+	if m.SHA256 == "" {
+		return errors.New("upload isn't signed for any image")
+	}
+	want, err := hex.DecodeString(m.SHA256)
+	if err != nil {
+		return errors.New("manifest has a malformed sha256")
+	}
+	if subtle.ConstantTimeCompare(want, sum) != 1 {
+		return errors.New("image doesn't match its signed sha256")
+	}
+	if m.Size != size {
+		return fmt.Errorf("image is %d bytes but %d were signed for", size, m.Size)
+	}
+	if m.Filename != filename {
+		return fmt.Errorf("filename %q doesn't match the signed %q", filename, m.Filename)
+	}
+	return nil
+}
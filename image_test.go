@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadBody builds a JSON image upload of img under filename, signed
+//	for the given manifest.
+func uploadBody(key *rsa.PrivateKey, nonce Nonce, filename string, img []byte, manifest ImageManifest) []byte {
+	payload, _ := json.Marshal(manifest)
+	var signed map[string]interface{}
+	json.Unmarshal(signRequest(key, nonce, "POST", "/upload/", payload), &signed)
+	signed["Img"] = base64.StdEncoding.EncodeToString(img)
+	signed["Filename"] = filename
+
+	body, _ := json.Marshal(signed)
+	return body
+}
+
+// testImage draws a small gradient and encodes it as the given type.
+func testImage(mimeType string, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	switch mimeType {
+	case "image/png":
+		png.Encode(&buf, img)
+	case "image/jpeg":
+		jpeg.Encode(&buf, img, nil)
+	case "image/gif":
+		gif.Encode(&buf, img, nil)
+	}
+	return buf.Bytes()
+}
+
+// useTempImageDir keeps images in a fresh directory for the length of a
+//	test.
+func useTempImageDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, oldStorage := config.ImageDir, imageStorage
+	config.ImageDir = dir
+	imageStorage = newLocalStorage(dir, config.ImageURL)
+	return func() {
+		config.ImageDir, imageStorage = old, oldStorage
+		os.RemoveAll(dir)
+	}
+}
+
+func TestUploadChecksSignedManifest(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	img := testImage("image/png", 40, 30)
+	sum := sha256.Sum256(img)
+	manifest := ImageManifest{Filename: "cat.png", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(img))}
+
+	cases := []struct {
+		name     string
+		filename string
+		img      []byte
+		manifest ImageManifest
+		ok       bool
+	}{
+		{"swapped image", "cat.png", []byte("something else entirely"), manifest, false},
+		{"renamed file", "dog.png", img, manifest, false},
+		{"no manifest", "cat.png", img, ImageManifest{}, false},
+		{"matching upload", "cat.png", img, manifest, true},
+	}
+	for _, c := range cases {
+		nonce, _ := getNonce(router, "/nonce/")
+		code := post(router, "/upload/", uploadBody(key, nonce, c.filename, c.img, c.manifest))
+		if ok := code < 300; ok != c.ok {
+			t.Errorf("%s: got status %d", c.name, code)
+		}
+	}
+
+	if images, _ := imageStore.ListImages(); len(images) != 1 {
+		t.Errorf("expected exactly one stored image, got %d", len(images))
+	}
+}
+
+func TestUploadWithoutTempDir(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	// Like our production image, which has no /tmp
+	t.Setenv("TMPDIR", filepath.Join(config.ImageDir, "does-not-exist"))
+	img := testImage("image/png", 40, 30)
+	sum := sha256.Sum256(img)
+	manifest := ImageManifest{Filename: "cat.png", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(img))}
+	nonce, _ := getNonce(router, "/nonce/")
+	if code := post(router, "/upload/", uploadBody(key, nonce, "cat.png", img, manifest)); code >= 300 {
+		t.Fatalf("upload failed with %d", code)
+	}
+	files, _ := filepath.Glob(filepath.Join(config.ImageDir, ".upload-*"))
+	if len(files) != 0 {
+		t.Errorf("spooled upload left behind: %v", files)
+	}
+
+	// Anywhere else it has to exist
+	cfg := DefaultConfig()
+	cfg.ImageStorage, cfg.S3 = "s3", S3Config{Endpoint: "https://s3.example.com", Bucket: "b", Region: "r", AccessKey: "a", SecretKey: "s"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "upload directory") {
+		t.Errorf("expected a complaint about the upload directory, got %v", err)
+	}
+}
+
+// signedUpload builds a streamed upload request with the signature for
+//	manifest in the X-Signature header.
+func signedUpload(key *rsa.PrivateKey, nonce Nonce, method, path, contentType string, body []byte, manifest ImageManifest) *http.Request {
+	payload, _ := json.Marshal(manifest)
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(signRequest(key, nonce, method, path, payload)))
+	return r
+}
+
+func TestStreamedUploads(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func(size int64) { config.MaxImageSize = size }(config.MaxImageSize)
+	config.MaxImageSize = 1000
+	router := NewRouter()
+
+	manifestFor := func(filename string, img []byte) ImageManifest {
+		sum := sha256.Sum256(img)
+		return ImageManifest{Filename: filename, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(img))}
+	}
+	small := testImage("image/gif", 20, 10)
+	other := testImage("image/gif", 10, 20)
+	big := append([]byte("\xff\xd8\xff"), make([]byte, 2000)...)
+	html := []byte("<html><script>alert(1)</script></html>")
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("title", "ignored")
+	part, _ := mw.CreateFormFile("image", "party.gif")
+	part.Write(small)
+	mw.Close()
+
+	cases := []struct {
+		name string
+		req  func(Nonce) *http.Request
+		want int
+	}{
+		{"multipart", func(n Nonce) *http.Request {
+			return signedUpload(key, n, "POST", "/upload/", mw.FormDataContentType(), form.Bytes(), manifestFor("party.gif", small))
+		}, http.StatusCreated},
+		{"PUT", func(n Nonce) *http.Request {
+			return signedUpload(key, n, "PUT", "/upload/other.gif", "application/octet-stream", other, manifestFor("other.gif", other))
+		}, http.StatusCreated},
+		{"uploaded again", func(n Nonce) *http.Request {
+			return signedUpload(key, n, "PUT", "/upload/again.gif", "image/gif", small, manifestFor("again.gif", small))
+		}, http.StatusOK},
+		{"too big", func(n Nonce) *http.Request {
+			return signedUpload(key, n, "PUT", "/upload/huge.jpg", "image/jpeg", big, manifestFor("huge.jpg", big))
+		}, http.StatusRequestEntityTooLarge},
+		{"not an image", func(n Nonce) *http.Request {
+			return signedUpload(key, n, "PUT", "/upload/cat.png", "image/png", html, manifestFor("cat.png", html))
+		}, http.StatusUnsupportedMediaType},
+		{"bad signature", func(n Nonce) *http.Request {
+			return signedUpload(key, Nonce{Value: []byte("made up")}, "PUT", "/upload/party.gif", "image/gif", small, manifestFor("party.gif", small))
+		}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		nonce, _ := getNonce(router, "/nonce/")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, c.req(nonce))
+		if rec.Code != c.want {
+			t.Errorf("%s: expected %d, got %d (%s)", c.name, c.want, rec.Code, rec.Body.String())
+		}
+	}
+
+	// The good uploads are stored under their IDs with the extension that
+	//	goes with their contents, and nothing else is left behind,
+	//	temporary files included
+	files, _ := filepath.Glob(filepath.Join(config.ImageDir, "*"))
+	if len(files) != 2 || filepath.Ext(files[0]) != ".gif" || filepath.Ext(files[1]) != ".gif" {
+		t.Errorf("unexpected files in the image directory: %v", files)
+	}
+	if images, _ := imageStore.ListImages(); len(images) != 2 {
+		t.Errorf("expected two stored images, got %d", len(images))
+	}
+
+	// Images from before they had IDs are known by the MD5 of their file
+	legacy := testImage("image/gif", 15, 15)
+	sum := md5.Sum(legacy)
+	legacyID := hex.EncodeToString(sum[:])
+	imageStore.InsertImage(Image{ID: legacyID, Filename: legacyID + ".gif", Title: "old"})
+	nonce, _ := getNonce(router, "/nonce/")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, signedUpload(key, nonce, "PUT", "/upload/old.gif", "image/gif", legacy, manifestFor("old.gif", legacy)))
+	var img Image
+	json.Unmarshal(rec.Body.Bytes(), &img)
+	if rec.Code != http.StatusOK || img.ID != legacyID {
+		t.Errorf("legacy re-upload: got %d %+v", rec.Code, img)
+	}
+	if images, _ := imageStore.ListImages(); len(images) != 3 {
+		t.Errorf("expected three stored images, got %d", len(images))
+	}
+}
+
+// TestImageVariants uploads a phone-style photo: stored sideways, with an
+//	orientation tag and location data.
+func TestImageVariants(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	plain := testImage("image/jpeg", 1000, 600)
+	var photo bytes.Buffer
+	photo.Write(plain[:2])
+	xmp := "http://ns.adobe.com/xap/1.0/\x00<exif:GPSLatitude>47,39.0N</exif:GPSLatitude>"
+	photo.Write([]byte{0xff, 0xe1, 0, byte(len(xmp) + 2)})
+	photo.WriteString(xmp)
+	photo.Write(plain[2:])
+	insertOrientation(&photo, 6)
+
+	sum := sha256.Sum256(photo.Bytes())
+	manifest := ImageManifest{Filename: "hike.jpg", SHA256: hex.EncodeToString(sum[:]), Size: int64(photo.Len())}
+	nonce, _ := getNonce(router, "/nonce/")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, signedUpload(key, nonce, "PUT", "/upload/hike.jpg", "image/jpeg", photo.Bytes(), manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: got %d (%s)", rec.Code, rec.Body.String())
+	}
+	var img Image
+	json.Unmarshal(rec.Body.Bytes(), &img)
+
+	// The photo is displayed upright, and the variants that fit are made
+	if img.Width != 600 || img.Height != 1000 {
+		t.Errorf("expected a 600x1000 image, got %dx%d", img.Width, img.Height)
+	}
+	want := map[string][2]int{"thumb": {120, 200}, "480w": {480, 800}}
+	if len(img.Variants) != len(want) {
+		t.Errorf("expected variants %v, got %+v", want, img.Variants)
+	}
+	for _, v := range img.Variants {
+		data, err := ioutil.ReadFile(filepath.Join(config.ImageDir, v.Filename))
+		if err != nil {
+			t.Errorf("%s: %v", v.Name, err)
+			continue
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil || [2]int{cfg.Width, cfg.Height} != want[v.Name] || [2]int{v.Width, v.Height} != want[v.Name] {
+			t.Errorf("%s: expected %v, file is %dx%d and record says %dx%d", v.Name, want[v.Name], cfg.Width, cfg.Height, v.Width, v.Height)
+		}
+		if v.URL != config.ImageURL+v.Filename || v.Type != "image/jpeg" {
+			t.Errorf("%s: unexpected variant %+v", v.Name, v)
+		}
+	}
+
+	// The original keeps its orientation but loses the location
+	original, err := ioutil.ReadFile(filepath.Join(config.ImageDir, img.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(original, []byte("GPSLatitude")) {
+		t.Error("location data was left in the original")
+	}
+	if o := jpegOrientation(original); o != 6 {
+		t.Errorf("expected the original to keep orientation 6, got %d", o)
+	}
+}
+
+// TestStripMetadata covers the image types and files the upload test
+//	doesn't.
+func TestStripMetadata(t *testing.T) {
+	gps := "<exif:GPSLatitude>47,39.0N</exif:GPSLatitude>"
+	chunk := func(fourCC string, payload string) string {
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(payload)))
+		if len(payload)%2 == 1 {
+			payload += "\x00"
+		}
+		return fourCC + string(size[:]) + payload
+	}
+	riff := func(chunks string) []byte {
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(chunks)+4))
+		return []byte("RIFF" + string(size[:]) + "WEBP" + chunks)
+	}
+
+	// WebP loses its EXIF and XMP chunks and the flags for them
+	webp := riff(chunk("VP8X", "\x2c\x00\x00\x00\x09\x00\x00\x09\x00\x00") + chunk("VP8L", "pixels") + chunk("EXIF", gps) + chunk("XMP ", "<x>"+gps+"</x>"))
+	out, err := stripMetadata(webp, "image/webp")
+	want := riff(chunk("VP8X", "\x20\x00\x00\x00\x09\x00\x00\x09\x00\x00") + chunk("VP8L", "pixels"))
+	if err != nil || !bytes.Equal(out, want) {
+		t.Errorf("stripped WebP:\n%q\nexpected\n%q (%v)", out, want, err)
+	}
+	if _, err := stripMetadata(webp[:len(webp)-3], "image/webp"); err == nil {
+		t.Error("a WebP we can't read should be refused")
+	}
+
+	// GIF loses comments and XMP but keeps looping
+	var anim bytes.Buffer
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	gif.EncodeAll(&anim, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+	plain := anim.Bytes()
+	at := bytes.IndexByte(plain, 0x2c)
+	extensions := "\x21\xfe\x05hello\x00" + "\x21\xff\x0bXMP DataXMP" + string([]byte{byte(len(gps))}) + gps + "\x00"
+	tagged := []byte(string(plain[:at]) + extensions + string(plain[at:]))
+	if out, err = stripMetadata(tagged, "image/gif"); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("stripped GIF:\n%q\nexpected\n%q (%v)", out, plain, err)
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(out)); err != nil || len(g.Image) != 2 {
+		t.Errorf("stripped GIF doesn't decode: %v", err)
+	}
+
+	// JPEG loses comments and application segments other than the
+	//	JFIF header, colour profile and Adobe's, but keeps its orientation
+	jpg := testImage("image/jpeg", 20, 10)
+	segment := func(marker byte, payload string) string {
+		return string([]byte{0xff, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}) + payload
+	}
+	exif := "Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00"
+	kept := segment(0xe2, "ICC_PROFILE\x00\x01\x01profile") + segment(0xee, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+	tagged = []byte(string(jpg[:2]) + segment(0xfe, "GPS 1,2,3!") + segment(0xe1, exif+gps) + kept +
+		segment(0xe3, gps) + segment(0xed, "Photoshop 3.0\x00"+gps) + segment(0xef, gps) + string(jpg[2:]))
+	if out, err = stripMetadata(tagged, "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("GPS")) {
+		t.Errorf("stripped JPEG still has metadata: %q", out[:200])
+	}
+	if !bytes.Contains(out, []byte(kept)) || jpegOrientation(out) != 6 {
+		t.Errorf("stripped JPEG lost what decoding needs: %q", out[:200])
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(out)); err != nil {
+		t.Errorf("stripped JPEG doesn't decode: %v", err)
+	}
+
+	// A JPEG the segment walker can't follow (here because of a fill
+	//	byte) is made again from its pixels
+	odd := append(append([]byte{}, jpg[:2]...), 0xff, 0xff, 0xe1, 0, byte(len(gps)+2))
+	odd = append(append(odd, gps...), jpg[2:]...)
+	if _, ok := stripJPEG(odd); ok {
+		t.Fatal("expected the segment walker to give up")
+	}
+	out, err = stripMetadata(odd, "image/jpeg")
+	if err != nil || bytes.Contains(out, []byte("GPSLatitude")) {
+		t.Errorf("JPEG kept its metadata: %v", err)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(out)); err != nil || cfg.Width != 20 || cfg.Height != 10 {
+		t.Errorf("re-encoded JPEG is wrong: %+v %v", cfg, err)
+	}
+}
+
+func TestServeImage(t *testing.T) {
+	defer useTempImageDir(t)()
+	router := NewRouter()
+
+	data := testImage("image/png", 40, 30)
+	if err := ioutil.WriteFile(filepath.Join(config.ImageDir, "0123abcd.png"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(config.ImageDir, ".upload-123"), data, 0600)
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := get("/img/0123abcd.png")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("GET: got %d and %d bytes", rec.Code, rec.Body.Len())
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != `"0123abcd"` || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("Last-Modified") == "" {
+		t.Errorf("unexpected headers %v", rec.Header())
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Errorf("expected an immutable Cache-Control, got %q", cc)
+	}
+
+	if rec := get("/img/0123abcd.png", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: expected %d, got %d", http.StatusNotModified, rec.Code)
+	}
+	rec = get("/img/0123abcd.png", "Range", "bytes=1-3")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[1:4]) {
+		t.Errorf("Range: got %d and %q", rec.Code, rec.Body.Bytes())
+	}
+	for _, path := range []string{"/img/missing.png", "/img/.upload-123"} {
+		if rec := get(path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusNotFound, rec.Code)
+		}
+	}
+}
+
+// stuckStorage is an ImageStorage that can't delete anything.
+type stuckStorage struct {
+	ImageStorage
+}
+
+func (stuckStorage) Delete(name string) error {
+	return errors.New("read-only file system")
+}
+
+func TestImageDelete(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	data := testImage("image/png", 600, 400)
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	manifest := ImageManifest{Filename: "sea.png", SHA256: id, Size: int64(len(data))}
+	nonce, _ := getNonce(router, "/nonce/")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, signedUpload(key, nonce, "PUT", "/upload/sea.png", "image/png", data, manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload: got %d (%s)", rec.Code, rec.Body.String())
+	}
+
+	show := func() int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/image/"+id, nil))
+		return rec.Code
+	}
+	remove := func() int {
+		nonce, _ := getNonce(router, "/nonce/")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("DELETE", "/image/"+id, bytes.NewReader(signRequest(key, nonce, "DELETE", "/image/"+id, nil))))
+		return rec.Code
+	}
+	if code := show(); code != http.StatusOK {
+		t.Errorf("GET: expected %d, got %d", http.StatusOK, code)
+	}
+
+	// If the file can't go, neither does the record
+	working := imageStorage
+	imageStorage = stuckStorage{working}
+	if code := remove(); code != http.StatusInternalServerError {
+		t.Errorf("DELETE with stuck storage: expected %d, got %d", http.StatusInternalServerError, code)
+	}
+	imageStorage = working
+	if code := show(); code != http.StatusOK {
+		t.Errorf("image should survive a failed delete, got %d", code)
+	}
+
+	if code := remove(); code != http.StatusNoContent {
+		t.Errorf("DELETE: expected %d, got %d", http.StatusNoContent, code)
+	}
+	if files, _ := filepath.Glob(filepath.Join(config.ImageDir, "*")); len(files) != 0 {
+		t.Errorf("files left behind: %v", files)
+	}
+	if code := show(); code != http.StatusNotFound {
+		t.Errorf("GET after DELETE: expected %d, got %d", http.StatusNotFound, code)
+	}
+	if code := remove(); code != http.StatusNotFound {
+		t.Errorf("second DELETE: expected %d, got %d", http.StatusNotFound, code)
+	}
+}
+
+func TestImageUpdate(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	imageStore.InsertImage(Image{ID: "sea", Filename: "sea.png", Title: "sea", AltText: "sea", Date: time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)})
+	imageStore.InsertImage(Image{ID: "hills", Filename: "hills.png", Title: "hills", AltText: "hills", Date: time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)})
+
+	patch := func(id string, payload string) *httptest.ResponseRecorder {
+		nonce, _ := getNonce(router, "/nonce/")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("PATCH", "/image/"+id, bytes.NewReader(signRequest(key, nonce, "PATCH", "/image/"+id, []byte(payload)))))
+		return rec
+	}
+
+	rec := patch("sea", `{"title": "The Sea at Dusk", "alttext": " Waves breaking on a rocky beach ", "credit": "Nico"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH: expected %d, got %d (%s)", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	img, _ := RepoGetImage("sea")
+	if img.Title != "The Sea at Dusk" || img.AltText != "Waves breaking on a rocky beach" || img.Credit != "Nico" || img.Caption != "" {
+		t.Errorf("unexpected image after editing: %+v", img)
+	}
+
+	// Fields that aren't mentioned are left alone
+	if rec := patch("sea", `{"caption": "Taken from the lighthouse"}`); rec.Code != http.StatusOK {
+		t.Errorf("PATCH caption: expected %d, got %d", http.StatusOK, rec.Code)
+	}
+	if img, _ := RepoGetImage("sea"); img.Caption != "Taken from the lighthouse" || img.Credit != "Nico" {
+		t.Errorf("unexpected image after editing the caption: %+v", img)
+	}
+
+	for _, c := range []struct {
+		id, payload string
+		code        int
+	}{
+		{"sea", `{"alttext": "  "}`, http.StatusBadRequest},
+		{"sea", `{"title": ""}`, http.StatusBadRequest},
+		{"sea", `{"credit": "` + strings.Repeat("x", maxImageText+1) + `"}`, http.StatusBadRequest},
+		{"nope", `{"title": "Nope"}`, http.StatusNotFound},
+	} {
+		if rec := patch(c.id, c.payload); rec.Code != c.code {
+			t.Errorf("PATCH %s %s: expected %d, got %d", c.id, c.payload, c.code, rec.Code)
+		}
+	}
+	if img, _ := RepoGetImage("sea"); img.AltText != "Waves breaking on a rocky beach" {
+		t.Errorf("rejected edits shouldn't change anything, got %+v", img)
+	}
+
+	list := func(query string) (int, []string) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/images/"+query, nil))
+		var images Images
+		json.Unmarshal(rec.Body.Bytes(), &images)
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		return rec.Code, ids
+	}
+	for query, want := range map[string]string{
+		"":                                   "hills sea",
+		"?title=DUSK":                        "sea",
+		"?since=2020-01-01":                  "hills",
+		"?until=2019-06-01":                  "sea",
+		"?until=2019-06-01T11:00:00Z":        "",
+		"?title=the&since=2020-01-01":        "",
+		"?since=2019-01-01&until=2021-01-01": "hills sea",
+	} {
+		if code, ids := list(query); code != http.StatusOK || strings.Join(ids, " ") != want {
+			t.Errorf("GET /images/%s: got %d %v, expected %q", query, code, ids, want)
+		}
+	}
+	if code, _ := list("?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("bad date: expected %d, got %d", http.StatusBadRequest, code)
+	}
+}
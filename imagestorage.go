@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImageStorage holds the image files themselves, while the ImageStore
+//	keeps track of them. Names are plain file names (no directories).
+type ImageStorage interface {
+	// Put stores content under name, replacing anything already there.
+	Put(name string, content io.ReadSeeker, contentType string) error
+
+	// Get opens a stored file, or returns ErrNotFound.
+	Get(name string) (ImageFile, error)
+
+	// Delete removes a stored file, or returns ErrNotFound.
+	Delete(name string) error
+
+	// URL is where the public can find the file.
+	URL(name string) string
+
+	// List returns every stored file.
+	List() ([]StoredFile, error)
+}
+
+// StoredFile describes a file in an ImageStorage.
+type StoredFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// ImageFile is a stored image opened for reading.
+type ImageFile interface {
+	io.ReadSeeker
+	io.Closer
+	ModTime() time.Time
+}
+
+// imageStorage is where image files are kept.
+var imageStorage ImageStorage = newLocalStorage(config.ImageDir, config.ImageURL)
+
+// OpenImageStorage sets up the image storage chosen in cfg.
+func OpenImageStorage(cfg Config) error {
+	switch cfg.ImageStorage {
+	case "local":
+		imageStorage = newLocalStorage(cfg.ImageDir, cfg.ImageURL)
+	case "s3":
+		s, err := newS3Storage(cfg.S3)
+		if err != nil {
+			return err
+		}
+		imageStorage = s
+	default:
+		return fmt.Errorf("unknown image storage %q", cfg.ImageStorage)
+	}
+	return nil
+}
+
+// localStorage keeps images in a directory, which something (possibly us,
+//	see ServeImage) serves at url.
+type localStorage struct {
+	dir string
+	url string
+}
+
+func newLocalStorage(dir string, url string) *localStorage {
+	return &localStorage{dir: dir, url: url}
+}
+
+// path finds the file for name. Names that could reach outside the
+//	directory, or that belong to files still being written (which start
+//	with a dot), don't exist as far as anyone else is concerned.
+func (s *localStorage) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// Put implements ImageStorage. The file is written under a temporary
+//	name first so nobody ever sees half of it.
+func (s *localStorage) Put(name string, content io.ReadSeeker, contentType string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return fmt.Errorf("bad image name %q", name)
+	}
+
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get implements ImageStorage.
+func (s *localStorage) Get(name string) (ImageFile, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return &localFile{f, info.ModTime()}, nil
+}
+
+// Delete implements ImageStorage.
+func (s *localStorage) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// URL implements ImageStorage.
+func (s *localStorage) URL(name string) string {
+	return s.url + name
+}
+
+// List implements ImageStorage. Files still being written are left out.
+func (s *localStorage) List() ([]StoredFile, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []StoredFile
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		files = append(files, StoredFile{info.Name(), info.Size(), info.ModTime()})
+	}
+	return files, nil
+}
+
+// localFile is an ImageFile on disk.
+type localFile struct {
+	*os.File
+	modTime time.Time
+}
+
+func (f *localFile) ModTime() time.Time {
+	return f.modTime
+}
@@ -1,10 +1,55 @@
 package main
 
+import (
+	"errors"
+	"time"
+)
+
 // Input is the information we expect from the client to create a new post.
+//	Leaving Tags or either publishing time out of an update keeps what
+//	the post has. ClearSchedule takes the post off its schedule first,
+//	so it can be sent alone or with new times. Status is only read when
+//	the post is created, and defaults to a draft; after that it's
+//	changed through /post/{postID}/status.
 type Input struct {
-	Title    string `json:"title"`
-	Body     string `json:"body"`
-	Markdown string `json:"markdown"`
+	Title         string     `json:"title"`
+	Body          string     `json:"body"`
+	Markdown      string     `json:"markdown"`
+	Tags          []string   `json:"tags"`
+	Status        string     `json:"status,omitempty"`
+	PublishAt     *time.Time `json:"publishat,omitempty"`
+	UnpublishAt   *time.Time `json:"unpublishat,omitempty"`
+	ClearSchedule bool       `json:"clearschedule,omitempty"`
+}
+
+// ErrBadSchedule means a post would come down before it went up.
+var ErrBadSchedule = errors.New("unpublishat must be after publishat")
+
+// checkSchedule makes sure a publishing window isn't empty.
+func checkSchedule(publishAt *time.Time, unpublishAt *time.Time) error {
+	if publishAt != nil && unpublishAt != nil && !unpublishAt.After(*publishAt) {
+		return ErrBadSchedule
+	}
+	return nil
+}
+
+// StatusChange is the payload for moving a post to another state.
+type StatusChange struct {
+	Status string `json:"status"`
+}
+
+// renderBody replaces the input's Body with its Markdown made into HTML,
+//	when the server is set to do that and there is some Markdown.
+func (in *Input) renderBody() error {
+	if !config.RenderMarkdown || in.Markdown == "" {
+		return nil
+	}
+	body, err := renderMarkdown(in.Markdown)
+	if err != nil {
+		return err
+	}
+	in.Body = body
+	return nil
 }
 
 // SignedInput is an Input/Signature/Nonce triple.
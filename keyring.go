@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultKeyID is the ID used for the single key in config.PublicKey, and
+//	for signed requests that don't say which key they used.
+const defaultKeyID = "default"
+
+// TrustedKey is a public key belonging to one of our editors. Key is an
+//	*rsa.PublicKey, a P-256 *ecdsa.PublicKey or an ed25519.PublicKey, and
+//	decides which signature algorithm is expected. RSA keys accept both
+//	PKCS#1 v1.5 and PSS signatures unless Algorithm pins one of them.
+type TrustedKey struct {
+	ID        string
+	Key       crypto.PublicKey
+	Algorithm string
+	Disabled  bool
+	Expires   time.Time
+}
+
+// usable returns an error if the key shouldn't be accepted right now.
+func (k *TrustedKey) usable(now time.Time) error {
+	if k.Disabled {
+		return fmt.Errorf("key %s is disabled", k.ID)
+	}
+	if !k.Expires.IsZero() && now.After(k.Expires) {
+		return fmt.Errorf("key %s expired at %s", k.ID, k.Expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Keyring holds the keys we accept signatures from. Each key lives in its
+//	own PEM file in the keyring directory and its ID is the file name
+//	without the .pem extension. Keys can be switched off or given an
+//	expiry with PEM headers:
+//
+//		-----BEGIN PUBLIC KEY-----
+//		Algorithm: RSA-PSS
+//		Disabled: true
+//		Expires: 2027-01-01T00:00:00Z
+//
+//		MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA...
+//		-----END PUBLIC KEY-----
+//
+//	The directory is read again by Reload, so keys can be added, changed
+//	or removed without restarting the server.
+type Keyring struct {
+	mu          sync.RWMutex
+	dir         string
+	legacy      string
+	keys        map[string]*TrustedKey
+	fingerprint string
+}
+
+// keyring is the set of keys used to check signed requests.
+var keyring = NewKeyring("", "")
+
+// NewKeyring makes an empty keyring for the keys in dir. If legacy names
+//	a PEM file, that key is trusted too under the ID "default".
+func NewKeyring(dir string, legacy string) *Keyring {
+	return &Keyring{
+		dir:    dir,
+		legacy: legacy,
+		keys:   make(map[string]*TrustedKey),
+	}
+}
+
+// Lookup finds the key with the given ID and makes sure it may be used.
+func (k *Keyring) Lookup(id string) (*TrustedKey, error) {
+	if id == "" {
+		id = defaultKeyID
+	}
+
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	if err := key.usable(time.Now()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Len returns the number of keys on the ring, usable or not.
+func (k *Keyring) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return len(k.keys)
+}
+
+// add puts a key on the ring directly. This is for tests; real keys come
+//	from the keyring directory.
+func (k *Keyring) add(key *TrustedKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[key.ID] = key
+}
+
+// Reload reads every key from disk again. If anything is wrong the old
+//	keys are kept and the error is returned.
+func (k *Keyring) Reload() error {
+	// Take the fingerprint first, so a file that changes while we're
+	//	reading it gets read again on the next check
+	fingerprint, _ := k.scan()
+	keys := make(map[string]*TrustedKey)
+
+	if k.legacy != "" {
+		key, err := readTrustedKey(k.legacy, defaultKeyID)
+		if err != nil {
+			return err
+		}
+		keys[defaultKeyID] = key
+	}
+
+	if k.dir != "" {
+		files, err := filepath.Glob(filepath.Join(k.dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			id := strings.TrimSuffix(filepath.Base(file), ".pem")
+			key, err := readTrustedKey(file, id)
+			if err != nil {
+				return err
+			}
+			keys[id] = key
+		}
+	}
+
+	if len(keys) == 0 {
+		return errors.New("no public keys found")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = keys
+	k.fingerprint = fingerprint
+	return nil
+}
+
+// scan returns a string that changes whenever a key file is added,
+//	removed or modified.
+func (k *Keyring) scan() (string, error) {
+	var files []string
+	if k.dir != "" {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(k.dir, "*.pem")); err != nil {
+			return "", err
+		}
+	}
+	if k.legacy != "" {
+		files = append(files, k.legacy)
+	}
+	sort.Strings(files)
+
+	var parts []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, file, strconv.FormatInt(info.ModTime().UnixNano(), 10), strconv.FormatInt(info.Size(), 10))
+	}
+	return strings.Join(parts, "|"), nil
+}
+
+// WatchEvery reloads the keyring whenever the key files change, checking
+//	on the given interval until stop is closed.
+func (k *Keyring) WatchEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fingerprint, err := k.scan()
+			if err != nil {
+				log.Print("Couldn't check keyring: ", err)
+				continue
+			}
+
+			k.mu.RLock()
+			changed := fingerprint != k.fingerprint
+			k.mu.RUnlock()
+
+			if changed {
+				if err := k.Reload(); err != nil {
+					log.Print("Keyring changed but couldn't be reloaded: ", err)
+					continue
+				}
+				log.Printf("Reloaded keyring (%d keys)", k.Len())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// readTrustedKey parses a PEM public key file, including its headers.
+func readTrustedKey(path string, id string) (*TrustedKey, error) {
+	pubStr, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open public key file: %v", err)
+	}
+	block, _ := pem.Decode(pubStr)
+	if block == nil {
+		return nil, fmt.Errorf("couldn't decode public key from %s", path)
+	}
+	puKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse public key %s: %v", path, err)
+	}
+	switch k := puKey.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("public key %s uses %s, only P-256 is supported", path, k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("public key %s is a %T, which we can't check signatures with", path, puKey)
+	}
+
+	key := &TrustedKey{ID: id, Key: puKey}
+	if v, ok := block.Headers["Algorithm"]; ok {
+		if _, isRSA := puKey.(*rsa.PublicKey); !isRSA || (v != algRSAPKCS1v15 && v != algRSAPSS) {
+			return nil, fmt.Errorf("%s: bad Algorithm header %q", path, v)
+		}
+		key.Algorithm = v
+	}
+	if v, ok := block.Headers["Disabled"]; ok {
+		if key.Disabled, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("%s: bad Disabled header %q", path, v)
+		}
+	}
+	if v, ok := block.Headers["Expires"]; ok {
+		if key.Expires, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("%s: bad Expires header %q", path, v)
+		}
+	}
+	return key, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKey makes an RSA key, saves the public half as dir/id.pem with
+//	the given PEM headers and returns the private half.
+func writeKey(t *testing.T, dir string, id string, headers map[string]string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, dir, id, key.Public(), headers)
+	return key
+}
+
+// writePublicKey saves pub as dir/id.pem with the given PEM headers.
+func writePublicKey(t *testing.T, dir string, id string, pub crypto.PublicKey, headers map[string]string) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: headers, Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, id+".pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := writeKey(t, dir, "alice", nil)
+	writeKey(t, dir, "bob", map[string]string{"Disabled": "true"})
+	writeKey(t, dir, "carol", map[string]string{"Expires": "2001-01-01T00:00:00Z"})
+
+	ring := NewKeyring(dir, "")
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ring.Len() != 3 {
+		t.Errorf("expected 3 keys, got %d", ring.Len())
+	}
+	if _, err := ring.Lookup("alice"); err != nil {
+		t.Error(err)
+	}
+	for _, id := range []string{"bob", "carol", "dave", ""} {
+		if _, err := ring.Lookup(id); err == nil {
+			t.Errorf("key %q should not be usable", id)
+		}
+	}
+
+	// Signed requests say which key they used
+	keyring = ring
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	nonce, _ := getNonce(router, "/nonce/")
+	if code := post(router, "/posts/all/", signRequestAs(alice, "alice", nonce, "POST", "/posts/all/", nil)); code != http.StatusOK {
+		t.Errorf("request signed by alice: expected %d, got %d", http.StatusOK, code)
+	}
+	nonce, _ = getNonce(router, "/nonce/")
+	if code := post(router, "/posts/all/", signRequestAs(alice, "carol", nonce, "POST", "/posts/all/", nil)); code != http.StatusUnauthorized {
+		t.Errorf("request claiming to be carol: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	// New keys show up without a restart
+	stop := make(chan struct{})
+	defer close(stop)
+	go ring.WatchEvery(10*time.Millisecond, stop)
+
+	writeKey(t, dir, "dave", nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := ring.Lookup("dave"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("new key was never picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A broken key file doesn't take the working keys down with it
+	if err := ioutil.WriteFile(filepath.Join(dir, "eve.pem"), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ring.Reload(); err == nil {
+		t.Error("reload with a broken key file should fail")
+	}
+	if _, err := ring.Lookup("alice"); err != nil {
+		t.Errorf("old keys should survive a failed reload: %v", err)
+	}
+}
+
+func TestKeyringKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	writePublicKey(t, dir, "ed", edPub, nil)
+	writePublicKey(t, dir, "ec", p256.Public(), nil)
+	writeKey(t, dir, "pss", map[string]string{"Algorithm": "RSA-PSS"})
+
+	ring := NewKeyring(dir, "")
+	if err := ring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ring.Lookup("pss"); err != nil || key.Algorithm != algRSAPSS {
+		t.Errorf("expected a PSS-only RSA key, got %+v (%v)", key, err)
+	}
+
+	// Other curves aren't supported
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	writePublicKey(t, dir, "p384", p384.Public(), nil)
+	if err := ring.Reload(); err == nil {
+		t.Error("a P-384 key should be rejected")
+	}
+
+	// and neither is asking for PSS with a non-RSA key
+	writePublicKey(t, dir, "p384", edPub, map[string]string{"Algorithm": "RSA-PSS"})
+	if err := ring.Reload(); err == nil {
+		t.Error("an Algorithm header on an Ed25519 key should be rejected")
+	}
+}
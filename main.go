@@ -1,13 +1,103 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-var devmode bool
-
 func main() {
-	router := NewRouter()
-	log.Fatal(http.ListenAndServe(":8080", router))
+	cfg, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
+
+	keyring = NewKeyring(config.KeyDir, config.PublicKey)
+	if err := keyring.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	if err := OpenStores(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := OpenImageStorage(config); err != nil {
+		log.Fatal(err)
+	}
+	if err := RepoFillPostStatus(); err != nil {
+		log.Print("Couldn't fill in post statuses: ", err)
+	}
+	if err := RepoReindexImageRefs(); err != nil {
+		log.Print("Couldn't index image references: ", err)
+	}
+	if err := RepoRebuildSearchIndex(); err != nil {
+		log.Print("Couldn't build the search index: ", err)
+	}
+
+	// Keep the nonce store tidy and the keyring up to date, and note
+	//	scheduled posts going up and down
+	stop := make(chan struct{})
+	defer close(stop)
+	go challenges.CollectEvery(time.Minute, stop)
+	go keyring.WatchEvery(30*time.Second, stop)
+	go WatchScheduleEvery(time.Minute, stop)
+	go reloadKeysOnHangup(stop)
+
+	server := &http.Server{
+		Addr:    config.Listen,
+		Handler: NewRouter(),
+	}
+
+	// Shut down cleanly when asked to, letting requests in flight finish
+	//	before the database connections go away.
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		log.Print("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		close(done)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+
+	if err := CloseStores(); err != nil {
+		log.Print(err)
+	}
+}
+
+// reloadKeysOnHangup rereads the keyring whenever we get a SIGHUP.
+func reloadKeysOnHangup(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := keyring.Reload(); err != nil {
+				log.Print("Couldn't reload keyring: ", err)
+				continue
+			}
+			log.Printf("Reloaded keyring (%d keys)", keyring.Len())
+		case <-stop:
+			return
+		}
+	}
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdown turns post Markdown into HTML when -render-markdown is on:
+//	GitHub-flavoured Markdown (tables, strikethrough, task lists and
+//	bare links) with footnotes and TeX math. Fenced code gets a
+//	language-<name> class for the frontend's highlighter. Posts only
+//	come from signed requests, so HTML in the Markdown is let through
+//	as it always has been.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote, mathExtension{}),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// renderMarkdown returns the HTML for a post's Markdown.
+func renderMarkdown(src string) (string, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(src), &buf); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// mathExtension keeps TeX between $...$ (inline) and $$...$$ (display)
+//	away from the Markdown parser, so underscores and backslashes in it
+//	come through untouched for MathJax or KaTeX to typeset. It's written
+//	out HTML-escaped, with \( \) or \[ \] around it, in a span with the
+//	class "math inline" or "math display". As in Pandoc, a $ only opens
+//	math when it isn't followed by a space, and only closes it when it
+//	isn't after a space or before a digit, so prices like $5 stay as
+//	they are. \( and \[ are left as the Markdown escapes they are,
+//	which is also Pandoc's default.
+type mathExtension struct{}
+
+// Extend implements goldmark.Extender.
+func (mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(util.Prioritized(mathParser{}, 100)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(mathRenderer{}, 100)))
+}
+
+var kindMath = ast.NewNodeKind("Math")
+
+// mathNode is a piece of TeX found by mathParser.
+type mathNode struct {
+	ast.BaseInline
+	display bool
+	tex     []byte
+}
+
+// Kind implements ast.Node.
+func (n *mathNode) Kind() ast.NodeKind {
+	return kindMath
+}
+
+// Dump implements ast.Node.
+func (n *mathNode) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.tex)}, nil)
+}
+
+// mathDelimiters pairs up the ways math can start with how it ends.
+var mathDelimiters = []struct {
+	open, close string
+	display     bool
+}{
+	{"$$", "$$", true},
+	{"$", "$", false},
+}
+
+type mathParser struct{}
+
+// Trigger implements parser.InlineParser.
+func (mathParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// Parse implements parser.InlineParser. Anything that turns out not to
+//	be math is left for the other parsers.
+func (mathParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	for _, delim := range mathDelimiters {
+		if !bytes.HasPrefix(line, []byte(delim.open)) {
+			continue
+		}
+		if delim.open == "$" && (len(line) < 2 || util.IsSpace(line[1])) {
+			return nil
+		}
+
+		l, pos := block.Position()
+		block.Advance(len(delim.open))
+		var tex []byte
+		for {
+			line, _ := block.PeekLine()
+			if line == nil {
+				block.SetPosition(l, pos)
+				return nil
+			}
+			for i := 0; i < len(line); i++ {
+				if bytes.HasPrefix(line[i:], []byte(delim.close)) {
+					content := append(tex, line[:i]...)
+					if closesMath(delim.close, content, line[i+len(delim.close):]) {
+						block.Advance(i + len(delim.close))
+						return &mathNode{display: delim.display, tex: content}
+					}
+				}
+				if line[i] == '\\' {
+					// Escaped characters (\$ say) never end the math
+					i++
+				}
+			}
+			tex = append(tex, line...)
+			block.AdvanceLine()
+		}
+	}
+	return nil
+}
+
+// closesMath reports whether close really ends math with the given
+//	content, with rest following it.
+func closesMath(close string, content []byte, rest []byte) bool {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return false
+	}
+	if close != "$" {
+		return true
+	}
+	if util.IsSpace(content[len(content)-1]) {
+		return false
+	}
+	return len(rest) == 0 || rest[0] < '0' || rest[0] > '9'
+}
+
+type mathRenderer struct{}
+
+// RegisterFuncs implements renderer.NodeRenderer.
+func (mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMath, renderMath)
+}
+
+func renderMath(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*mathNode)
+	if n.display {
+		w.WriteString(`<span class="math display">\[`)
+		w.Write(util.EscapeHTML(n.tex))
+		w.WriteString(`\]</span>`)
+	} else {
+		w.WriteString(`<span class="math inline">\(`)
+		w.Write(util.EscapeHTML(n.tex))
+		w.WriteString(`\)</span>`)
+	}
+	return ast.WalkSkipChildren, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for _, c := range []struct{ src, want string }{
+		{"| a | b |\n|---|---|\n| 1 | 2 |\n", "<table>\n<thead>\n<tr>\n<th>a</th>\n<th>b</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>1</td>\n<td>2</td>\n</tr>\n</tbody>\n</table>\n"},
+		{"```go\nx := 1 < 2\n```\n", "<pre><code class=\"language-go\">x := 1 &lt; 2\n</code></pre>\n"},
+		{"~~old~~ news", "<p><del>old</del> news</p>\n"},
+		{"Let $x_1 < y_2$ be *small*.", `<p>Let <span class="math inline">\(x_1 &lt; y_2\)</span> be <em>small</em>.</p>` + "\n"},
+		{`See \[1\] \(and \*this\*\)`, "<p>See [1] (and *this*)</p>\n"},
+		{"$$\n\\int_0^1 f\n$$", "<p><span class=\"math display\">\\[\n\\int_0^1 f\n\\]</span></p>\n"},
+		{`$\$5$`, `<p><span class="math inline">\(\$5\)</span></p>` + "\n"},
+		{"It costs $5 or $10.", "<p>It costs $5 or $10.</p>\n"},
+		{"Between $ signs $ isn't math, \\$ and \\( are escapes", "<p>Between $ signs $ isn't math, $ and ( are escapes</p>\n"},
+		{"`$x$` is code", "<p><code>$x$</code> is code</p>\n"},
+		{"$<script>alert(1)</script>$", `<p><span class="math inline">\(&lt;script&gt;alert(1)&lt;/script&gt;\)</span></p>` + "\n"},
+	} {
+		got, err := renderMarkdown(c.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("rendering %q:\nexpected %q\ngot      %q", c.src, c.want, got)
+		}
+	}
+
+	got, _ := renderMarkdown("Fermat[^1]\n\n[^1]: Too small a margin.\n")
+	if !strings.Contains(got, `<a href="#fn:1"`) || !strings.Contains(got, "Too small a margin.") {
+		t.Errorf("footnote not rendered: %s", got)
+	}
+}
+
+func TestRenderedPosts(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+	defer func(render bool) { config.RenderMarkdown = render }(config.RenderMarkdown)
+
+	// The client's HTML is kept unless the server's set to render
+	config.RenderMarkdown = false
+	var post Post
+	json.Unmarshal(sendSigned(router, key, "POST", "/post/", Input{Title: "Client side", Markdown: "*hi*", Body: "<p>mine</p>"}).Body.Bytes(), &post)
+	if post.Body != "<p>mine</p>" {
+		t.Errorf("client's body replaced: %q", post.Body)
+	}
+
+	config.RenderMarkdown = true
+	json.Unmarshal(sendSigned(router, key, "POST", "/post/", Input{Title: "Server side", Markdown: "*hi*", Body: "<p>ignored</p>"}).Body.Bytes(), &post)
+	if post.Body != "<p><em>hi</em></p>\n" {
+		t.Errorf("body not rendered on create: %q", post.Body)
+	}
+	sendSigned(router, key, "POST", "/post/"+strconv.Itoa(int(post.ID)), Input{Title: "Server side", Markdown: "**bye**", Body: "<p>ignored</p>"})
+	if p, _ := postStore.PostByID(post.ID); p.Body != "<p><strong>bye</strong></p>\n" {
+		t.Errorf("body not rendered on update: %q", p.Body)
+	}
+	json.Unmarshal(sendSigned(router, key, "POST", "/post/", Input{Title: "HTML only", Body: "<p>raw</p>"}).Body.Bytes(), &post)
+	if post.Body != "<p>raw</p>" {
+		t.Errorf("posts without Markdown should keep their body: %q", post.Body)
+	}
+}
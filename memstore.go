@@ -0,0 +1,259 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryStore keeps everything in process memory. Nothing survives a
+//	restart, which makes it handy for tests and local development.
+type memoryStore struct {
+	mu        sync.RWMutex
+	posts     []Post
+	images    []Image
+	revisions map[uint32][]Revision
+	rsvps     map[string]Rsvp
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{revisions: make(map[uint32][]Revision), rsvps: make(map[string]Rsvp)}
+}
+
+// InsertPost implements PostStore.
+func (s *memoryStore) InsertPost(post Post) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	taken := make(map[string]bool)
+	for _, p := range s.posts {
+		if p.ID == post.ID {
+			return Post{}, ErrExists
+		}
+		taken[p.URLTitle] = true
+	}
+	for taken[post.URLTitle] {
+		post.URLTitle += "0"
+	}
+	s.posts = append(s.posts, post)
+	return post, nil
+}
+
+// UpdatePost implements PostStore.
+func (s *memoryStore) UpdatePost(id uint32, change func(post *Post) error) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.posts {
+		if s.posts[i].ID == id {
+			post := s.posts[i]
+			post.Tags = append([]string(nil), post.Tags...)
+			post.Images = append([]string(nil), post.Images...)
+			if err := change(&post); err != nil {
+				return Post{}, err
+			}
+			s.posts[i] = post
+			return post, nil
+		}
+	}
+	return Post{}, ErrNotFound
+}
+
+// PostByID implements PostStore.
+func (s *memoryStore) PostByID(id uint32) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, post := range s.posts {
+		if post.ID == id {
+			return post, nil
+		}
+	}
+	return Post{}, ErrNotFound
+}
+
+// PostByURLTitle implements PostStore.
+func (s *memoryStore) PostByURLTitle(urlTitle string) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, post := range s.posts {
+		if post.URLTitle == urlTitle {
+			return post, nil
+		}
+	}
+	return Post{}, ErrNotFound
+}
+
+// URLTitleExists implements PostStore.
+func (s *memoryStore) URLTitleExists(urlTitle string) (bool, error) {
+	_, err := s.PostByURLTitle(urlTitle)
+	return err == nil, nil
+}
+
+// ListPosts implements PostStore.
+func (s *memoryStore) ListPosts(visibleOnly bool) (Posts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := Posts{}
+	for _, post := range s.posts {
+		if visibleOnly && !post.Visible {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// InsertImage implements ImageStore.
+func (s *memoryStore) InsertImage(img Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.images {
+		if existing.ID == img.ID {
+			return ErrExists
+		}
+	}
+	s.images = append(s.images, img)
+	return nil
+}
+
+// ImageByID implements ImageStore.
+func (s *memoryStore) ImageByID(id string) (Image, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, img := range s.images {
+		if img.ID == id {
+			return img, nil
+		}
+	}
+	return Image{}, ErrNotFound
+}
+
+// SaveImage implements ImageStore.
+func (s *memoryStore) SaveImage(img Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, existing := range s.images {
+		if existing.ID == img.ID {
+			s.images[i] = img
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// DeleteImage implements ImageStore.
+func (s *memoryStore) DeleteImage(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, img := range s.images {
+		if img.ID == id {
+			s.images = append(s.images[:i], s.images[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// ListImages implements ImageStore.
+func (s *memoryStore) ListImages() (Images, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append(Images{}, s.images...), nil
+}
+
+// InsertRevision implements RevisionStore.
+func (s *memoryStore) InsertRevision(rev Revision) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revs := s.revisions[rev.PostID]
+	for _, existing := range revs {
+		if existing.Number == rev.Number {
+			return ErrExists
+		}
+	}
+	revs = append(revs, rev)
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Number < revs[j].Number })
+	s.revisions[rev.PostID] = revs
+	return nil
+}
+
+// AppendRevision implements RevisionStore.
+func (s *memoryStore) AppendRevision(rev Revision) (Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revs := s.revisions[rev.PostID]
+	rev.Number = 1
+	if len(revs) > 0 {
+		rev.Number = revs[len(revs)-1].Number + 1
+	}
+	s.revisions[rev.PostID] = append(revs, rev)
+	return rev, nil
+}
+
+// Revisions implements RevisionStore.
+func (s *memoryStore) Revisions(postID uint32) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]Revision{}, s.revisions[postID]...), nil
+}
+
+// RevisionByNumber implements RevisionStore.
+func (s *memoryStore) RevisionByNumber(postID uint32, number int) (Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, rev := range s.revisions[postID] {
+		if rev.Number == number {
+			return rev, nil
+		}
+	}
+	return Revision{}, ErrNotFound
+}
+
+// AddRSVP seeds an RSVP. There is no API route for creating them, so
+//	this is only used when setting up tests or a dev server.
+func (s *memoryStore) AddRSVP(rsvp Rsvp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rsvps[rsvp.ShortCode] = rsvp
+}
+
+// RSVPByShortCode implements RsvpStore.
+func (s *memoryStore) RSVPByShortCode(rescode string) (Rsvp, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rsvp, ok := s.rsvps[rescode]
+	if !ok {
+		return Rsvp{}, ErrNotFound
+	}
+	return rsvp, nil
+}
+
+// UpdateRSVP implements RsvpStore.
+func (s *memoryStore) UpdateRSVP(rescode string, attending bool, mon int, sun int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rsvp, ok := s.rsvps[rescode]
+	if !ok {
+		return ErrNotFound
+	}
+	rsvp.Attending = attending
+	rsvp.Updated = true
+	rsvp.MonConfirm = mon
+	rsvp.SunConfirm = sun
+	s.rsvps[rescode] = rsvp
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePosts(t *testing.T) {
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+
+	post, err := RepoCreatePost(Post{
+		Title:    "Hello",
+		URLTitle: "hello",
+		Visible:  true,
+		Date:     time.Now(),
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !RepoURLTitleExists("hello") {
+		t.Error("urltitle should exist after creating the post")
+	}
+	if again, err := RepoCreatePost(Post{Title: "Hello", URLTitle: "hello", Date: time.Now()}, ""); err != nil || again.URLTitle != "hello0" {
+		t.Errorf("second post should get urltitle hello0, got %q (%v)", again.URLTitle, err)
+	}
+
+	id := strconv.Itoa(int(post.ID))
+	if err := RepoUpdatePost(id, Input{Title: "Hello again", Body: "b", Markdown: "m"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if p := RepoGetPost("hello"); p.Title != "Hello again" || p.Body != "b" {
+		t.Errorf("update not stored: %+v", p)
+	}
+
+	if err := RepoTogglePost(id); err != nil {
+		t.Fatal(err)
+	}
+	if RepoGetPost("hello").ID != 0 {
+		t.Error("hidden post should not be returned")
+	}
+	if visible, err := RepoGetVisiblePosts(); err != nil || len(visible) != 0 {
+		t.Errorf("expected no visible posts, got %d (%v)", len(visible), err)
+	}
+	if all, _ := postStore.ListPosts(false); len(all) != 2 {
+		t.Errorf("expected two posts in total, got %d", len(all))
+	}
+
+	if err := RepoUpdatePost("12345", Input{}, ""); err == nil {
+		t.Error("updating a missing post should fail")
+	}
+}
+
+func TestMemoryStoreHandlers(t *testing.T) {
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	RepoCreatePost(Post{Title: "Shown", URLTitle: "shown", Visible: true, Date: time.Now()}, "")
+	RepoCreatePost(Post{Title: "Hidden", URLTitle: "hidden", Date: time.Now()}, "")
+	rsvpStore.(*memoryStore).AddRSVP(Rsvp{ShortCode: "abc", Name: "Guest", NumInvited: 2})
+
+	router := NewRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/posts/", nil))
+	var posts Posts
+	if err := json.Unmarshal(rec.Body.Bytes(), &posts); err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 1 || posts[0].URLTitle != "shown" {
+		t.Errorf("unexpected post list: %+v", posts)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/post/hidden", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("hidden post: expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/rsvp/abc", nil))
+	var rsvp Rsvp
+	if err := json.Unmarshal(rec.Body.Bytes(), &rsvp); err != nil {
+		t.Fatal(err)
+	}
+	if rsvp.Name != "Guest" {
+		t.Errorf("unexpected rsvp: %+v", rsvp)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoStore keeps posts, images and RSVPs in MongoDB. It holds on to one
+//	long-lived session for the life of the server and hands a copy of it to
+//	each call, so the sockets get pooled instead of dialing every time.
+type mongoStore struct {
+	session    *mgo.Session
+	reconnects int64
+}
+
+// mongoPoolStats is a snapshot of the connection pool for /stats/db/.
+type mongoPoolStats struct {
+	Addrs        []string `json:"addrs"`
+	Reconnects   int64    `json:"reconnects"`
+	SocketsAlive int      `json:"socketsalive"`
+	SocketsInUse int      `json:"socketsinuse"`
+	SocketRefs   int      `json:"socketrefs"`
+	SentOps      int      `json:"sentops"`
+	ReceivedOps  int      `json:"receivedops"`
+	ReceivedDocs int      `json:"receiveddocs"`
+}
+
+// openMongoStore dials addr and keeps trying for a little while, since
+//	the database container may well come up after we do.
+func openMongoStore(addr string) (*mongoStore, error) {
+	mgo.SetStats(true)
+
+	var session *mgo.Session
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		session, err = mgo.DialWithTimeout(addr, 10*time.Second)
+		if err == nil {
+			break
+		}
+		log.Printf("Couldn't reach MongoDB at %s (attempt %d): %v", addr, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mongoStore{session: session}
+	if err := s.migrateImageIDs(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := s.mergeDuplicateImages(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	err = s.revisions(func(c *mgo.Collection) error {
+		return c.EnsureIndex(mgo.Index{Key: []string{"postid", "number"}, Unique: true})
+	})
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	err = s.posts(func(c *mgo.Collection) error {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+			return err
+		}
+		return c.EnsureIndex(mgo.Index{Key: []string{"urltitle"}, Unique: true})
+	})
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("couldn't index posts (are there duplicate IDs or urltitles?): %v", err)
+	}
+	return s, nil
+}
+
+// migrateImageIDs gives an ID to every image stored before images had
+//	them. Their files are named after the MD5 of their contents, so that
+//	is what they get.
+func (s *mongoStore) migrateImageIDs() error {
+	return s.images(func(c *mgo.Collection) error {
+		var old []struct {
+			DocID    bson.ObjectId `bson:"_id"`
+			Filename string        `bson:"filename"`
+		}
+		if err := c.Find(bson.M{"id": bson.M{"$exists": false}}).All(&old); err != nil {
+			return err
+		}
+		for _, img := range old {
+			id := legacyImageID(img.Filename)
+			if err := c.UpdateId(img.DocID, bson.M{"$set": bson.M{"id": id}}); err != nil {
+				return err
+			}
+		}
+		if len(old) > 0 {
+			log.Printf("Gave IDs to %d images", len(old))
+		}
+		return nil
+	})
+}
+
+// mergeDuplicateImages folds the records left by uploading the same file
+//	more than once (from before uploads were deduplicated) into one per
+//	ID, then makes sure there's never more than one again.
+func (s *mongoStore) mergeDuplicateImages() error {
+	return s.images(func(c *mgo.Collection) error {
+		var all []struct {
+			DocID bson.ObjectId `bson:"_id"`
+			Image `bson:",inline"`
+		}
+		if err := c.Find(nil).Sort("_id").All(&all); err != nil {
+			return err
+		}
+		docs := make(map[string][]bson.ObjectId)
+		images := make(map[string][]Image)
+		for _, img := range all {
+			docs[img.ID] = append(docs[img.ID], img.DocID)
+			images[img.ID] = append(images[img.ID], img.Image)
+		}
+
+		merged := 0
+		for id, ids := range docs {
+			if len(ids) < 2 {
+				continue
+			}
+			if err := c.UpdateId(ids[0], mergeImages(images[id])); err != nil {
+				return err
+			}
+			for _, doc := range ids[1:] {
+				if err := c.RemoveId(doc); err != nil {
+					return err
+				}
+			}
+			merged += len(ids) - 1
+		}
+		if merged > 0 {
+			log.Printf("Merged %d duplicate image records", merged)
+		}
+
+		return c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true})
+	})
+}
+
+// withCollection hands fn a collection on a fresh copy of the shared
+//	session and returns the copy to the pool afterwards. If the copy
+//	hits a connection problem the shared session is refreshed so the
+//	next request gets a working socket.
+func (s *mongoStore) withCollection(db string, table string, fn func(c *mgo.Collection) error) error {
+	session := s.session.Copy()
+	defer session.Close()
+
+	err := fn(session.DB(db).C(table))
+	switch err.(type) {
+	case nil:
+		return nil
+	case *mgo.LastError, *mgo.QueryError:
+		return err
+	}
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if err == ErrNotFound || err == ErrExists {
+		return err
+	}
+
+	// Anything else means the socket is no good
+	log.Print("Refreshing MongoDB session after error: ", err)
+	atomic.AddInt64(&s.reconnects, 1)
+	s.session.Refresh()
+	return err
+}
+
+func (s *mongoStore) posts(fn func(c *mgo.Collection) error) error {
+	return s.withCollection("postDB", "posts", fn)
+}
+
+func (s *mongoStore) images(fn func(c *mgo.Collection) error) error {
+	return s.withCollection("postDB", "images", fn)
+}
+
+func (s *mongoStore) revisions(fn func(c *mgo.Collection) error) error {
+	return s.withCollection("postDB", "revisions", fn)
+}
+
+func (s *mongoStore) rsvps(fn func(c *mgo.Collection) error) error {
+	return s.withCollection("rsvpDB", "posts", fn)
+}
+
+// Stats reports on the connection pool.
+func (s *mongoStore) Stats() interface{} {
+	stats := mgo.GetStats()
+	return mongoPoolStats{
+		Addrs:        s.session.LiveServers(),
+		Reconnects:   atomic.LoadInt64(&s.reconnects),
+		SocketsAlive: stats.SocketsAlive,
+		SocketsInUse: stats.SocketsInUse,
+		SocketRefs:   stats.SocketRefs,
+		SentOps:      stats.SentOps,
+		ReceivedOps:  stats.ReceivedOps,
+		ReceivedDocs: stats.ReceivedDocs,
+	}
+}
+
+// Close shuts down the shared session and every socket in the pool.
+func (s *mongoStore) Close() error {
+	s.session.Close()
+	return nil
+}
+
+// InsertPost implements PostStore. The unique indexes on id and
+//	urltitle tell us when either is taken.
+func (s *mongoStore) InsertPost(post Post) (Post, error) {
+	err := s.posts(func(c *mgo.Collection) error {
+		for {
+			err := c.Insert(post)
+			if !mgo.IsDup(err) {
+				return err
+			}
+			n, err := c.Find(bson.M{"id": post.ID}).Count()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return ErrExists
+			}
+			post.URLTitle += "0"
+		}
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// maxUpdateTries is how many times UpdatePost goes back for a post that
+//	keeps being changed underneath it.
+const maxUpdateTries = 10
+
+// UpdatePost implements PostStore. Only the fields change touched are
+//	written, and only if nobody has changed them since we read the post;
+//	if somebody has, we read it again and start over.
+func (s *mongoStore) UpdatePost(id uint32, change func(post *Post) error) (Post, error) {
+	var post Post
+	err := s.posts(func(c *mgo.Collection) error {
+		for try := 0; try < maxUpdateTries; try++ {
+			if err := c.Find(bson.M{"id": id}).One(&post); err != nil {
+				return err
+			}
+			old, err := bsonFields(post)
+			if err != nil {
+				return err
+			}
+			if err := change(&post); err != nil {
+				return err
+			}
+			post.ID = id
+			fields, err := bsonFields(post)
+			if err != nil {
+				return err
+			}
+
+			match, set, unset := bson.M{"id": id}, bson.M{}, bson.M{}
+			for name, value := range fields {
+				if !reflect.DeepEqual(value, old[name]) {
+					match[name] = old[name]
+					set[name] = value
+				}
+			}
+			for name, value := range old {
+				if _, ok := fields[name]; !ok {
+					match[name] = value
+					unset[name] = ""
+				}
+			}
+			if len(set)+len(unset) == 0 {
+				return nil
+			}
+			update := bson.M{}
+			if len(set) > 0 {
+				update["$set"] = set
+			}
+			if len(unset) > 0 {
+				update["$unset"] = unset
+			}
+
+			err = c.Update(match, update)
+			if err != mgo.ErrNotFound {
+				return err
+			}
+		}
+		return fmt.Errorf("post %d kept changing while we tried to update it", id)
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// bsonFields returns the fields of v as they'd be stored.
+func bsonFields(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields bson.M
+	err = bson.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// PostByID implements PostStore.
+func (s *mongoStore) PostByID(id uint32) (Post, error) {
+	var post Post
+	err := s.posts(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"id": id}).One(&post)
+	})
+	return post, err
+}
+
+// PostByURLTitle implements PostStore.
+func (s *mongoStore) PostByURLTitle(urlTitle string) (Post, error) {
+	var post Post
+	err := s.posts(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"urltitle": urlTitle}).One(&post)
+	})
+	return post, err
+}
+
+// URLTitleExists implements PostStore.
+func (s *mongoStore) URLTitleExists(urlTitle string) (bool, error) {
+	var count int
+	err := s.posts(func(c *mgo.Collection) error {
+		var err error
+		count, err = c.Find(bson.M{"urltitle": urlTitle}).Count()
+		return err
+	})
+	return count >= 1, err
+}
+
+// ListPosts implements PostStore.
+func (s *mongoStore) ListPosts(visibleOnly bool) (Posts, error) {
+	query := bson.M{}
+	if visibleOnly {
+		query["visible"] = true
+	}
+
+	var posts Posts
+	err := s.posts(func(c *mgo.Collection) error {
+		return c.Find(query).All(&posts)
+	})
+	return posts, err
+}
+
+// InsertImage implements ImageStore.
+func (s *mongoStore) InsertImage(img Image) error {
+	return s.images(func(c *mgo.Collection) error {
+		err := c.Insert(img)
+		if mgo.IsDup(err) {
+			return ErrExists
+		}
+		return err
+	})
+}
+
+// ImageByID implements ImageStore.
+func (s *mongoStore) ImageByID(id string) (Image, error) {
+	img := Image{}
+	err := s.images(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"id": id}).One(&img)
+	})
+	return img, err
+}
+
+// SaveImage implements ImageStore.
+func (s *mongoStore) SaveImage(img Image) error {
+	return s.images(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"id": img.ID}, img)
+	})
+}
+
+// DeleteImage implements ImageStore.
+func (s *mongoStore) DeleteImage(id string) error {
+	return s.images(func(c *mgo.Collection) error {
+		return c.Remove(bson.M{"id": id})
+	})
+}
+
+// ListImages implements ImageStore.
+func (s *mongoStore) ListImages() (Images, error) {
+	var images Images
+	err := s.images(func(c *mgo.Collection) error {
+		return c.Find(bson.M{}).All(&images)
+	})
+	return images, err
+}
+
+// InsertRevision implements RevisionStore.
+func (s *mongoStore) InsertRevision(rev Revision) error {
+	return s.revisions(func(c *mgo.Collection) error {
+		err := c.Insert(rev)
+		if mgo.IsDup(err) {
+			return ErrExists
+		}
+		return err
+	})
+}
+
+// AppendRevision implements RevisionStore. The unique index on postid
+//	and number catches anyone who took the same number first, and we
+//	try again with the next one.
+func (s *mongoStore) AppendRevision(rev Revision) (Revision, error) {
+	err := s.revisions(func(c *mgo.Collection) error {
+		for {
+			var last Revision
+			err := c.Find(bson.M{"postid": rev.PostID}).Sort("-number").One(&last)
+			if err != nil && err != mgo.ErrNotFound {
+				return err
+			}
+			rev.Number = last.Number + 1
+			if err := c.Insert(rev); !mgo.IsDup(err) {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return Revision{}, err
+	}
+	return rev, nil
+}
+
+// Revisions implements RevisionStore.
+func (s *mongoStore) Revisions(postID uint32) ([]Revision, error) {
+	revisions := []Revision{}
+	err := s.revisions(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"postid": postID}).Sort("number").All(&revisions)
+	})
+	return revisions, err
+}
+
+// RevisionByNumber implements RevisionStore.
+func (s *mongoStore) RevisionByNumber(postID uint32, number int) (Revision, error) {
+	var rev Revision
+	err := s.revisions(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"postid": postID, "number": number}).One(&rev)
+	})
+	return rev, err
+}
+
+// RSVPByShortCode implements RsvpStore.
+func (s *mongoStore) RSVPByShortCode(rescode string) (Rsvp, error) {
+	var rsvp Rsvp
+	err := s.rsvps(func(c *mgo.Collection) error {
+		return c.Find(bson.M{"shortcode": rescode}).One(&rsvp)
+	})
+	return rsvp, err
+}
+
+// UpdateRSVP implements RsvpStore.
+func (s *mongoStore) UpdateRSVP(rescode string, attending bool, mon int, sun int) error {
+	return s.rsvps(func(c *mgo.Collection) error {
+		return c.Update(bson.M{"shortcode": rescode}, bson.M{"$set": bson.M{
+			"attending":  attending,
+			"updated":    true,
+			"monconfirm": mon,
+			"sunconfirm": sun,
+		}})
+	})
+}
@@ -1,67 +1,233 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
-	"log"
+	"encoding/base64"
+	"errors"
+	"sync"
 	"time"
 )
 
-// Nonce is very aptly named. The Created value allows the Value
-//	to be regularly cycled to avoid any precomputation.
+// Nonce is very aptly named. Each one is handed out to a single client
+//	as a challenge to sign, can be used exactly once and stops working
+//	at Expires to avoid any precomputation.
 type Nonce struct {
 	Value   []byte    `json:"value"`
 	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
 }
 
-var theNonce Nonce
-
-func init() {
-	UpdateNonce()
+// ChallengeStore keeps track of the nonces that have been handed out and
+//	not yet used. It is safe to use from many goroutines at once, and
+//	never holds more than max nonces, or more than perClient for any one
+//	client. Once either limit is reached it refuses to hand out more
+//	until some are used or expire, rather than throwing away nonces
+//	that editors may be about to sign.
+type ChallengeStore struct {
+	mu      sync.Mutex
+	nonces  map[string]challenge
+	clients map[string]int
+	// queue holds the nonces in the order they were issued, which is
+	//	also the order they expire in. Used nonces are left in it until
+	//	they reach the front.
+	queue      []string
+	max        int
+	perClient  int
+	ttl        time.Duration
+	renewAfter time.Duration
 }
 
-// NonceIsOlderThan returns a bool that reflects whether the nonce is older
-//	than the provided time in nanoseconds
-func NonceIsOlderThan(d time.Duration) bool {
-	return time.Since(theNonce.Created) > d
+// challenge is an outstanding nonce: when it stops working and who it
+//	was handed to.
+type challenge struct {
+	expires time.Time
+	client  string
 }
 
-// CurrentNonce checks first to make sure the nonce isn't too old. If it is,
-//	it updates the value BEFORE returning the new one. The entire Nonce
-//	object is returned to give the client a heads up if it is about to expire.
-func CurrentNonce() Nonce {
-	// Don't use nonces that are more than half an hour old
-	if NonceIsOlderThan(30 * time.Minute) {
-		UpdateNonce()
+// Reasons the store won't hand out a nonce.
+var (
+	ErrChallengesFull   = errors.New("too many nonces outstanding, try again later")
+	ErrTooManyForClient = errors.New("too many nonces outstanding for this client")
+	ErrUnknownChallenge = errors.New("nonce is unknown, used or expired")
+	ErrRenewTooSoon     = errors.New("nonce is too new to swap")
+)
+
+// maxClientChallenges is how many nonces one client can have outstanding.
+const maxClientChallenges = 64
+
+// challenges is the store used by the handlers.
+var challenges = NewChallengeStore(4096, 30*time.Minute)
+
+// NewChallengeStore makes a store holding up to max nonces that are
+//	each good for ttl. A nonce can be swapped for a new one once it's
+//	used up a third of that.
+func NewChallengeStore(max int, ttl time.Duration) *ChallengeStore {
+	return &ChallengeStore{
+		nonces:     make(map[string]challenge),
+		clients:    make(map[string]int),
+		max:        max,
+		perClient:  maxClientChallenges,
+		ttl:        ttl,
+		renewAfter: ttl / 3,
 	}
+}
 
-	// Return that bad boy
-	return theNonce
+// Issue creates a brand new nonce for client (whatever identifies them,
+//	such as their address) and remembers it.
+func (s *ChallengeStore) Issue(client string) (Nonce, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collect(time.Now())
+	if len(s.nonces) >= s.max {
+		return Nonce{}, ErrChallengesFull
+	}
+	if s.clients[client] >= s.perClient {
+		return Nonce{}, ErrTooManyForClient
+	}
+	return s.issue(client)
 }
 
-// VerifyNonce just checks whether the given nonce is the
-//	current nonce and returns a bool to that effect. Regardless
-//	of result the value of the current nonce is changed.
-func VerifyNonce(in []byte) bool {
-	// Update the nonce after checking for equality
-	defer UpdateNonce()
+// Renew swaps a nonce that has been outstanding for a while for a new
+//	one, for clients that would rather not risk it expiring. Since the
+//	old one goes away, this never adds to the nonces outstanding.
+func (s *ChallengeStore) Renew(old []byte) (Nonce, error) {
+	key := nonceKey(old)
 
-	return bytes.Equal(in, theNonce.Value)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.collect(now)
+	c, ok := s.nonces[key]
+	if !ok {
+		return Nonce{}, ErrUnknownChallenge
+	}
+	if now.Before(c.expires.Add(s.renewAfter - s.ttl)) {
+		return Nonce{}, ErrRenewTooSoon
+	}
+	s.remove(key)
+	return s.issue(c.client)
 }
 
-// UpdateNonce creates a new value and updates the field
-func UpdateNonce() {
+// issue does the work of Issue. The caller must hold s.mu.
+func (s *ChallengeStore) issue(client string) (Nonce, error) {
 	// we will use a 64-byte (512-bit) pseudorandom nonce
 	val := make([]byte, 64)
-	_, err := rand.Read(val)
-	if err != nil {
-		log.Fatal(err)
+	if _, err := rand.Read(val); err != nil {
+		return Nonce{}, err
 	}
-
-	// update the nonce with our new value
-	theNonce = Nonce{
+	now := time.Now()
+	nonce := Nonce{
 		Value:   val,
-		Created: time.Now(),
+		Created: now,
+		Expires: now.Add(s.ttl),
+	}
+
+	key := nonceKey(val)
+	s.nonces[key] = challenge{nonce.Expires, client}
+	s.clients[client]++
+	s.queue = append(s.queue, key)
+	return nonce, nil
+}
+
+// remove forgets a nonce. The caller must hold s.mu.
+func (s *ChallengeStore) remove(key string) {
+	c, ok := s.nonces[key]
+	if !ok {
+		return
 	}
+	delete(s.nonces, key)
+	if s.clients[c.client]--; s.clients[c.client] <= 0 {
+		delete(s.clients, c.client)
+	}
+}
+
+// Redeem checks whether the given nonce was issued by us and hasn't
+//	expired. Either way the nonce can't be used again afterwards.
+func (s *ChallengeStore) Redeem(in []byte) bool {
+	key := nonceKey(in)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.nonces[key]
+	if !ok {
+		return false
+	}
+	s.remove(key)
+
+	return time.Now().Before(c.expires)
+}
+
+// Revoke forgets a nonce without using it.
+func (s *ChallengeStore) Revoke(in []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(nonceKey(in))
+}
+
+// Len returns the number of outstanding nonces.
+func (s *ChallengeStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.nonces)
+}
+
+// Collect throws away every nonce that has expired.
+func (s *ChallengeStore) Collect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.collect(time.Now())
+}
+
+// CollectEvery runs Collect on the given interval until stop is closed.
+func (s *ChallengeStore) CollectEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Collect()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// collect does the work of Collect, working through the queue from the
+//	front until it reaches a nonce that's still good. The caller must
+//	hold s.mu.
+func (s *ChallengeStore) collect(now time.Time) {
+	for len(s.queue) > 0 {
+		key := s.queue[0]
+		if c, ok := s.nonces[key]; ok {
+			if now.Before(c.expires) {
+				break
+			}
+			s.remove(key)
+		}
+		s.queue = s.queue[1:]
+	}
+
+	// Nonces used early can pile up behind one that isn't; clear them
+	//	out once they outnumber the live ones
+	if len(s.queue) > 2*len(s.nonces)+64 {
+		live := make([]string, 0, len(s.nonces))
+		for _, key := range s.queue {
+			if _, ok := s.nonces[key]; ok {
+				live = append(live, key)
+			}
+		}
+		s.queue = live
+	}
+}
 
+// nonceKey turns a nonce value into a map key.
+func nonceKey(val []byte) string {
+	return base64.StdEncoding.EncodeToString(val)
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChallengesAreIndependentAndSingleUse(t *testing.T) {
+	s := NewChallengeStore(10, time.Minute)
+
+	a, err := s.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Redeem([]byte("not a nonce we handed out")) {
+		t.Error("unknown nonce was accepted")
+	}
+	if !s.Redeem(b.Value) {
+		t.Error("second client's nonce was rejected")
+	}
+	if !s.Redeem(a.Value) {
+		t.Error("first client's nonce should survive the second client using theirs")
+	}
+	if s.Redeem(a.Value) {
+		t.Error("nonce was accepted twice")
+	}
+}
+
+func TestChallengesExpire(t *testing.T) {
+	s := NewChallengeStore(10, 10*time.Millisecond)
+
+	n, err := s.Issue("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.Expires.After(n.Created) {
+		t.Errorf("expiry %v should be after creation %v", n.Expires, n.Created)
+	}
+	s.Issue("client")
+
+	time.Sleep(20 * time.Millisecond)
+	if s.Redeem(n.Value) {
+		t.Error("expired nonce was accepted")
+	}
+	s.Collect()
+	if s.Len() != 0 {
+		t.Errorf("expected expired nonces to be collected, %d left", s.Len())
+	}
+}
+
+func TestChallengeStoreIsBounded(t *testing.T) {
+	s := NewChallengeStore(3, time.Minute)
+	s.perClient = 2
+
+	first, _ := s.Issue("a")
+	s.Issue("a")
+	if _, err := s.Issue("a"); err != ErrTooManyForClient {
+		t.Errorf("expected ErrTooManyForClient, got %v", err)
+	}
+	s.Issue("b")
+	if _, err := s.Issue("c"); err != ErrChallengesFull {
+		t.Errorf("expected ErrChallengesFull, got %v", err)
+	}
+	if s.Len() != 3 {
+		t.Errorf("store should hold at most 3 nonces, has %d", s.Len())
+	}
+
+	// Nobody's nonce is thrown away to make room, and using one frees
+	//	up its place
+	if !s.Redeem(first.Value) {
+		t.Error("outstanding nonce should still be good")
+	}
+	if _, err := s.Issue("c"); err != nil {
+		t.Errorf("expected room for another nonce, got %v", err)
+	}
+}
+
+func TestChallengeRenew(t *testing.T) {
+	s := NewChallengeStore(2, time.Minute)
+	s.renewAfter = 20 * time.Millisecond
+
+	old, _ := s.Issue("a")
+	s.Issue("a")
+	if _, err := s.Renew(old.Value); err != ErrRenewTooSoon {
+		t.Errorf("expected ErrRenewTooSoon, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	// Swapping works even when the store is full, since it doesn't add
+	//	to it
+	fresh, err := s.Renew(old.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Redeem(old.Value) {
+		t.Error("swapped nonce should be gone")
+	}
+	if _, err := s.Renew([]byte("not a nonce we handed out")); err != ErrUnknownChallenge {
+		t.Errorf("expected ErrUnknownChallenge, got %v", err)
+	}
+	if !s.Redeem(fresh.Value) {
+		t.Error("new nonce should be good")
+	}
+}
+
+func TestNonceClientBehindProxy(t *testing.T) {
+	useTestKey(t)
+	defer func(proxies string) { config.TrustedProxies = proxies }(config.TrustedProxies)
+	router := NewRouter()
+	nonce := func(remote string, header http.Header) int {
+		req := httptest.NewRequest("GET", "/nonce/", nil)
+		req.RemoteAddr = remote
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	forwarded := func(addrs ...string) http.Header {
+		return http.Header{"X-Forwarded-For": addrs}
+	}
+
+	// Without a trusted proxy the headers are the client's word for it
+	for i := 0; i < maxClientChallenges; i++ {
+		nonce("203.0.113.5:1000", forwarded("198.51.100.1"))
+	}
+	if code := nonce("203.0.113.5:1000", forwarded("198.51.100.2")); code != http.StatusTooManyRequests {
+		t.Errorf("a made-up X-Forwarded-For got around the limit: %d", code)
+	}
+
+	// From a trusted proxy, one client using up its nonces leaves the
+	//	others alone, whatever it claims to be in front of the proxy
+	config.TrustedProxies = "10.0.0.0/8, 192.0.2.1"
+	for i := 0; i < maxClientChallenges; i++ {
+		nonce("10.0.0.1:1000", forwarded("198.51.100.9", "198.51.100.1"))
+	}
+	if code := nonce("10.0.0.1:1000", forwarded("198.51.100.2, 198.51.100.1")); code != http.StatusTooManyRequests {
+		t.Errorf("expected %d once the client used its nonces, got %d", http.StatusTooManyRequests, code)
+	}
+	if code := nonce("10.0.0.1:1000", forwarded("198.51.100.1", "10.0.0.2")); code != http.StatusTooManyRequests {
+		t.Errorf("a second proxy hid the client: %d", code)
+	}
+	if code := nonce("10.0.0.1:1000", forwarded("198.51.100.2")); code != http.StatusOK {
+		t.Errorf("another client behind the proxy was turned away: %d", code)
+	}
+	if code := nonce("192.0.2.1:1234", http.Header{"X-Real-Ip": {"198.51.100.3"}}); code != http.StatusOK {
+		t.Errorf("client from X-Real-IP was turned away: %d", code)
+	}
+
+	if err := (Config{TrustedProxies: "10.0.0.0/8,proxy"}).Validate(); err == nil || !strings.Contains(err.Error(), "trusted proxies") {
+		t.Errorf("expected a bad proxy to be caught, got %v", err)
+	}
+}
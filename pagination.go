@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxPageSize is the most posts a list will return at once, and how many
+//	it returns if the client doesn't say.
+const maxPageSize = 100
+
+// PostQuery picks out, orders and pages through a list of posts. The
+//	zero PostQuery returns the first maxPageSize posts by date, oldest
+//	first; parsePostQuery starts from the newest.
+type PostQuery struct {
+	// Sort is the time posts are ordered by: "date" (the default) or
+	//	"updated". Desc puts the latest first.
+	Sort string
+	Desc bool
+
+	// After and Before bound the post date, when they're set.
+	After  time.Time
+	Before time.Time
+
+	// Short, when set, keeps only the short posts (or only the long ones).
+	Short *bool
+
+	// Tag, when set, keeps only the posts with that tag.
+	Tag string
+
+	// Status, when set, keeps only the posts in that state.
+	Status string
+
+	// Limit is the size of the page, and Cursor where it starts.
+	Limit  int
+	Cursor *postCursor
+
+	// Summary leaves the body and Markdown out of the response.
+	Summary bool
+}
+
+// postCursor marks the last post on a page, so the next page can carry
+//	on after it however many posts have come and gone in the meantime.
+//	It only makes sense with the ordering it was made for.
+type postCursor struct {
+	Sort string    `json:"s"`
+	Desc bool      `json:"d"`
+	Time time.Time `json:"t"`
+	ID   uint32    `json:"i"`
+}
+
+// parsePostQuery reads a PostQuery from the query string:
+//
+//		sort=date|updated  order=desc|asc  since=<date>  until=<date>
+//		short=true|false  tag=<tag>  status=<status>  limit=<n>
+//		cursor=<next cursor>  summary=true
+//
+//	Dates are as for parseDateParam.
+func parsePostQuery(values url.Values) (PostQuery, error) {
+	q := PostQuery{Sort: "date", Desc: true, Limit: maxPageSize}
+
+	switch s := values.Get("sort"); s {
+	case "", "date":
+	case "updated":
+		q.Sort = s
+	default:
+		return q, fmt.Errorf("can't sort by %q", s)
+	}
+	switch o := values.Get("order"); o {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return q, fmt.Errorf("unknown order %q", o)
+	}
+
+	var err error
+	if q.After, err = parseDateParam(values.Get("since"), false); err != nil {
+		return q, errors.New("bad since date")
+	}
+	if q.Before, err = parseDateParam(values.Get("until"), true); err != nil {
+		return q, errors.New("bad until date")
+	}
+	if s := values.Get("short"); s != "" {
+		short, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("short must be true or false")
+		}
+		q.Short = &short
+	}
+	if s := values.Get("tag"); s != "" {
+		if q.Tag, err = normalizeTag(s); err != nil {
+			return q, err
+		}
+	}
+	if s := values.Get("status"); s != "" {
+		if !validStatus(s) {
+			return q, fmt.Errorf("unknown status %q", s)
+		}
+		q.Status = s
+	}
+	if s := values.Get("summary"); s != "" {
+		if q.Summary, err = strconv.ParseBool(s); err != nil {
+			return q, errors.New("summary must be true or false")
+		}
+	}
+
+	if s := values.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if s := values.Get("cursor"); s != "" {
+		var c postCursor
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err == nil {
+			err = json.Unmarshal(data, &c)
+		}
+		if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+			return q, errors.New("bad cursor, or one for a different order")
+		}
+		q.Cursor = &c
+	}
+	return q, nil
+}
+
+// sortTime is the time post is ordered by.
+func (q PostQuery) sortTime(post Post) time.Time {
+	if q.Sort == "updated" {
+		return post.Updated
+	}
+	return post.Date
+}
+
+// before reports whether a comes before b in the query's order. Posts
+//	with the same time are ordered by ID, so the order is always the same.
+func (q PostQuery) before(aTime time.Time, aID uint32, bTime time.Time, bID uint32) bool {
+	if !aTime.Equal(bTime) {
+		return aTime.Before(bTime) != q.Desc
+	}
+	if aID == bID {
+		return false
+	}
+	return (aID < bID) != q.Desc
+}
+
+// Page filters and sorts posts, and returns the page the query asks for
+//	along with the cursor for the next one ("" if this is the last).
+func (q PostQuery) Page(posts Posts) (Posts, string) {
+	page := Posts{}
+	for _, post := range posts {
+		if !q.After.IsZero() && post.Date.Before(q.After) {
+			continue
+		}
+		if !q.Before.IsZero() && !post.Date.Before(q.Before) {
+			continue
+		}
+		if q.Short != nil && post.IsShort != *q.Short {
+			continue
+		}
+		if q.Tag != "" && !hasTag(post, q.Tag) {
+			continue
+		}
+		if q.Status != "" && postStatus(post) != q.Status {
+			continue
+		}
+		if q.Cursor != nil && !q.before(q.Cursor.Time, q.Cursor.ID, q.sortTime(post), post.ID) {
+			continue
+		}
+		page = append(page, post)
+	}
+	sort.Slice(page, func(i, j int) bool {
+		return q.before(q.sortTime(page[i]), page[i].ID, q.sortTime(page[j]), page[j].ID)
+	})
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = maxPageSize
+	}
+	if len(page) <= limit {
+		return page, ""
+	}
+	page = page[:limit]
+	last := page[limit-1]
+	data, _ := json.Marshal(postCursor{q.Sort, q.Desc, q.sortTime(last), last.ID})
+	return page, base64.RawURLEncoding.EncodeToString(data)
+}
+
+// writePostPage sends a page of posts, with a Link header pointing at the
+//	next page if there is one.
+func writePostPage(w http.ResponseWriter, r *http.Request, posts Posts, next string, q PostQuery) {
+	// Responsibly declare our content type
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+	w.Header().Set("Access-Control-Expose-Headers", "Link")
+	if next != "" {
+		u := *r.URL
+		values := u.Query()
+		values.Set("cursor", next)
+		u.RawQuery = values.Encode()
+		w.Header().Set("Link", "<"+u.RequestURI()+`>; rel="next"`)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	var body interface{} = posts
+	if q.Summary {
+		summaries := []PostSummary{}
+		for _, p := range posts {
+			summaries = append(summaries, p.Summary())
+		}
+		body = summaries
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostListing(t *testing.T) {
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	// Five visible posts a day apart, one of them short, plus a hidden
+	//	one. The first was edited last.
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, title := range []string{"a", "b", "c", "d", "e"} {
+		date := start.AddDate(0, 0, i)
+		updated := date
+		if title == "a" {
+			updated = start.AddDate(0, 1, 0)
+		}
+		RepoCreatePost(Post{Title: title, URLTitle: title, Visible: true, IsShort: title == "c", Date: date, Updated: updated, Body: "<p>" + title + "</p>"}, "")
+	}
+	RepoCreatePost(Post{Title: "hidden", URLTitle: "hidden", Date: start}, "")
+
+	list := func(query string) (int, string, []string) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/posts/"+query, nil))
+		var posts []map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &posts)
+		var titles []string
+		for _, p := range posts {
+			title, _ := p["title"].(string)
+			if _, ok := p["body"]; !ok {
+				title += "*"
+			}
+			titles = append(titles, title)
+		}
+		return rec.Code, rec.Header().Get("Link"), titles
+	}
+
+	for query, want := range map[string]string{
+		"":                          "e d c b a",
+		"?order=asc":                "a b c d e",
+		"?sort=updated":             "a e d c b",
+		"?short=true":               "c",
+		"?short=false&order=asc":    "a b d e",
+		"?since=2020-01-02":         "e d c b",
+		"?until=2020-01-02":         "b a",
+		"?summary=true&limit=100":   "e* d* c* b* a*",
+		"?since=2021-01-01&limit=1": "",
+	} {
+		code, link, titles := list(query)
+		if code != http.StatusOK || link != "" || strings.Join(titles, " ") != want {
+			t.Errorf("GET /posts/%s: got %d %q %v, expected %q", query, code, link, titles, want)
+		}
+	}
+
+	// Follow the Link headers through every page
+	linkPattern := regexp.MustCompile(`^<(/posts/\?[^>]+)>; rel="next"$`)
+	var got []string
+	query := "?limit=2&sort=updated&order=asc"
+	for pages := 0; query != ""; pages++ {
+		if pages > 3 {
+			t.Fatal("too many pages")
+		}
+		code, link, titles := list(query)
+		if code != http.StatusOK {
+			t.Fatalf("GET /posts/%s: got %d", query, code)
+		}
+		got = append(got, strings.Join(titles, " "))
+		query = ""
+		if link != "" {
+			m := linkPattern.FindStringSubmatch(link)
+			if m == nil {
+				t.Fatalf("bad Link header %q", link)
+			}
+			query = strings.TrimPrefix(m[1], "/posts/")
+		}
+	}
+	if strings.Join(got, " | ") != "b c | d e | a" {
+		t.Errorf("unexpected pages %q", got)
+	}
+
+	// A cursor only works with the order it was made for
+	_, link, _ := list("?limit=2")
+	cursor := link[strings.Index(link, "cursor=")+7 : strings.Index(link, ">")]
+	if code, _, titles := list("?limit=2&cursor=" + cursor); code != http.StatusOK || strings.Join(titles, " ") != "c b" {
+		t.Errorf("second page: got %d %v", code, titles)
+	}
+	for _, query := range []string{"?order=asc&cursor=" + cursor, "?cursor=nonsense", "?limit=0", "?limit=101", "?sort=title", "?short=maybe", "?since=soon"} {
+		if code, _, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("GET /posts/%s: expected %d, got %d", query, http.StatusBadRequest, code)
+		}
+	}
+}
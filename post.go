@@ -4,18 +4,74 @@ import (
 	"time"
 )
 
-// Post contains all data for one blog post
+// Post contains all data for one blog post. Images holds the IDs of the
+//	uploaded images it uses, kept up to date whenever it's saved, and
+//	Tags its (normalized) tags. Status is where the post is in its
+//	life (see status.go); Visible is true just when it's published. A
+//	visible post with a PublishAt only goes public at that time, and
+//	one with an UnpublishAt comes down again at that time.
 type Post struct {
 	ID       uint32    `json:"_id"`
 	IsShort  bool      `json:"isshort"`
 	Title    string    `json:"title"`
 	URLTitle string    `json:"urltitle"`
+	Status   string    `json:"status"`
 	Visible  bool      `json:"visible"`
 	Date     time.Time `json:"date"`
 	Body     string    `json:"body"`
 	Markdown string    `json:"markdown"`
 	Updated  time.Time `json:"updated"`
+	Images   []string  `json:"images,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+
+	PublishAt   *time.Time `json:"publishat,omitempty"`
+	UnpublishAt *time.Time `json:"unpublishat,omitempty"`
 }
 
 // Posts is just an array of posts
 type Posts []Post
+
+// PostSummary is a post without its body or Markdown, for listings.
+type PostSummary struct {
+	ID       uint32    `json:"_id"`
+	IsShort  bool      `json:"isshort"`
+	Title    string    `json:"title"`
+	URLTitle string    `json:"urltitle"`
+	Status   string    `json:"status"`
+	Visible  bool      `json:"visible"`
+	Date     time.Time `json:"date"`
+	Updated  time.Time `json:"updated"`
+	Images   []string  `json:"images,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+
+	PublishAt   *time.Time `json:"publishat,omitempty"`
+	UnpublishAt *time.Time `json:"unpublishat,omitempty"`
+}
+
+// Summary returns the post without its body or Markdown.
+func (p Post) Summary() PostSummary {
+	return PostSummary{p.ID, p.IsShort, p.Title, p.URLTitle, postStatus(p), p.Visible, p.Date, p.Updated, p.Images, p.Tags, p.PublishAt, p.UnpublishAt}
+}
+
+// Public reports whether the post is up at the given time: it has to be
+//	visible, and inside its publishing window if it has one.
+func (p Post) Public(now time.Time) bool {
+	if !p.Visible {
+		return false
+	}
+	if p.PublishAt != nil && now.Before(*p.PublishAt) {
+		return false
+	}
+	return p.UnpublishAt == nil || now.Before(*p.UnpublishAt)
+}
+
+// publicPosts returns the posts that are up at the given time.
+func publicPosts(posts Posts, now time.Time) Posts {
+	public := Posts{}
+	for _, post := range posts {
+		if post.Public(now) {
+			public = append(public, post)
+		}
+	}
+	return public
+}
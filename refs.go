@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imageRefPattern matches the file name of an uploaded image or one of
+//	its variants wherever it turns up in a post, whatever URL it's
+//	behind. The first group is the image's ID: a SHA-256, or an MD5 for
+//	images from before they had IDs.
+var imageRefPattern = regexp.MustCompile(`\b([0-9a-f]{64}|[0-9a-f]{32})(?:-[0-9a-z]+)?\.(?i:png|jpe?g|gif|webp)\b`)
+
+// orphanGrace is how old an unused image or file has to be before it
+//	counts as an orphan, so an image uploaded for a post that's still
+//	being written isn't swept up.
+const orphanGrace = 24 * time.Hour
+
+// imageRefs returns the IDs of the images a post uses, in the order they
+//	first appear.
+func imageRefs(post Post) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, text := range []string{post.Markdown, post.Body} {
+		for _, m := range imageRefPattern.FindAllStringSubmatch(text, -1) {
+			if !seen[m[1]] {
+				seen[m[1]] = true
+				ids = append(ids, m[1])
+			}
+		}
+	}
+	return ids
+}
+
+// RepoImageReferences maps the ID of every image used by a post (visible
+//	or not) to the IDs of the posts using it.
+func RepoImageReferences() (map[string][]uint32, error) {
+	posts, err := postStore.ListPosts(false)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string][]uint32)
+	for _, post := range posts {
+		for _, id := range post.Images {
+			refs[id] = append(refs[id], post.ID)
+		}
+	}
+	return refs, nil
+}
+
+// RepoReindexImageRefs scans every post for the images it uses again and
+//	saves the ones that changed. It runs at startup, which also takes
+//	care of posts from before we kept track.
+func RepoReindexImageRefs() error {
+	posts, err := postStore.ListPosts(false)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, post := range posts {
+		refs := imageRefs(post)
+		if strings.Join(refs, ",") == strings.Join(post.Images, ",") {
+			continue
+		}
+		_, err := postStore.UpdatePost(post.ID, func(p *Post) error {
+			p.Images = imageRefs(*p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		changed++
+	}
+	if changed > 0 {
+		log.Printf("Updated the image references of %d posts", changed)
+	}
+	return nil
+}
+
+// OrphanReport lists the images no post uses and the stored files that
+//	don't belong to any image. Failed lists anything that couldn't be
+//	purged.
+type OrphanReport struct {
+	Images Images       `json:"images"`
+	Files  []StoredFile `json:"files"`
+	Purged bool         `json:"purged"`
+	Failed []string     `json:"failed,omitempty"`
+}
+
+// RepoFindOrphans looks for images and files that have been unused for
+//	longer than orphanGrace.
+func RepoFindOrphans() (OrphanReport, error) {
+	report := OrphanReport{Images: Images{}, Files: []StoredFile{}}
+	cutoff := time.Now().Add(-orphanGrace)
+
+	refs, err := RepoImageReferences()
+	if err != nil {
+		return report, err
+	}
+	images, err := imageStore.ListImages()
+	if err != nil {
+		return report, err
+	}
+	owned := make(map[string]bool)
+	for _, img := range images {
+		owned[img.Filename] = true
+		for _, v := range img.Variants {
+			owned[v.Filename] = true
+		}
+		if len(refs[img.ID]) == 0 && img.Date.Before(cutoff) {
+			report.Images = append(report.Images, img)
+		}
+	}
+
+	files, err := imageStorage.List()
+	if err != nil {
+		return report, err
+	}
+	for _, f := range files {
+		if !owned[f.Name] && f.ModTime.Before(cutoff) {
+			report.Files = append(report.Files, f)
+		}
+	}
+	sort.Slice(report.Files, func(i, j int) bool { return report.Files[i].Name < report.Files[j].Name })
+
+	return report, nil
+}
+
+// RepoPurgeOrphans deletes everything in the report, carrying on past
+//	anything that can't be deleted.
+func RepoPurgeOrphans(report *OrphanReport) {
+	for _, img := range report.Images {
+		if err := RepoDeleteImage(img.ID); err != nil && err != ErrNotFound {
+			log.Printf("Couldn't purge image %s: %v", img.ID, err)
+			report.Failed = append(report.Failed, img.ID)
+		}
+	}
+	for _, f := range report.Files {
+		if err := imageStorage.Delete(f.Name); err != nil && err != ErrNotFound {
+			log.Printf("Couldn't purge file %s: %v", f.Name, err)
+			report.Failed = append(report.Failed, f.Name)
+		}
+	}
+	report.Purged = true
+}
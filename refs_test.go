@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageRefs(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	md5 := strings.Repeat("c", 32)
+	post := Post{
+		Markdown: "![sea](https://nicocourts.com/img/" + sha + ".jpg) and again ![thumb](/img/" + sha + "-thumb.jpg)",
+		Body:     `<img src="https://bucket.example.com/` + md5 + `.PNG"> but not ` + strings.Repeat("d", 40) + `.png`,
+	}
+	refs := imageRefs(post)
+	if len(refs) != 2 || refs[0] != sha || refs[1] != md5 {
+		t.Errorf("unexpected references %v", refs)
+	}
+}
+
+func TestImageOrphans(t *testing.T) {
+	key := useTestKey(t)
+	defer useTempImageDir(t)()
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	// Three images from a while ago (two of them used by posts), one
+	//	that was only just uploaded, and two stray files
+	used, unused, forced, fresh := strings.Repeat("1", 64), strings.Repeat("2", 64), strings.Repeat("3", 64), strings.Repeat("4", 64)
+	old := time.Now().Add(-2 * orphanGrace)
+	for _, img := range []Image{
+		{ID: used, Filename: used + ".png", Date: old},
+		{ID: unused, Filename: unused + ".png", Date: old, Variants: []ImageVariant{{Filename: unused + "-thumb.png"}}},
+		{ID: forced, Filename: forced + ".png", Date: old},
+		{ID: fresh, Filename: fresh + ".png", Date: time.Now()},
+	} {
+		imageStore.InsertImage(img)
+	}
+	for _, name := range []string{used + ".png", unused + ".png", unused + "-thumb.png", forced + ".png", fresh + ".png", "stray.png", "new.png"} {
+		imageStorage.Put(name, bytes.NewReader([]byte(name)), "image/png")
+		if name != "new.png" {
+			os.Chtimes(filepath.Join(config.ImageDir, name), old, old)
+		}
+	}
+	RepoCreatePost(Post{Title: "Uses it", URLTitle: "uses-it", Markdown: "![x](/img/" + used + "-thumb.png)", Date: time.Now()}, "")
+	RepoCreatePost(Post{Title: "Also", URLTitle: "also", Markdown: "![x](https://cdn.example.com/" + forced + ".png)", Date: time.Now()}, "")
+
+	// Images in use can only be deleted on purpose
+	if rec := sendSigned(router, key, "DELETE", "/image/"+forced, json.RawMessage(`{}`)); rec.Code != http.StatusConflict {
+		t.Errorf("deleting a used image: expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+	if rec := sendSigned(router, key, "DELETE", "/image/"+forced, json.RawMessage(`{"force": true}`)); rec.Code != http.StatusNoContent {
+		t.Errorf("forced delete: expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+
+	check := func(rec *httptest.ResponseRecorder, purged bool) {
+		var report OrphanReport
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("bad report %q: %v", rec.Body.String(), err)
+		}
+		if len(report.Images) != 1 || report.Images[0].ID != unused {
+			t.Errorf("unexpected orphaned images %+v", report.Images)
+		}
+		if len(report.Files) != 1 || report.Files[0].Name != "stray.png" {
+			t.Errorf("unexpected orphaned files %+v", report.Files)
+		}
+		if report.Purged != purged || len(report.Failed) != 0 {
+			t.Errorf("unexpected report %+v", report)
+		}
+	}
+	check(sendSigned(router, key, "POST", "/images/orphans/", json.RawMessage(`{}`)), false)
+	if _, err := RepoGetImage(unused); err != nil {
+		t.Error("listing orphans shouldn't delete them")
+	}
+	check(sendSigned(router, key, "POST", "/images/orphans/", json.RawMessage(`{"purge": true}`)), true)
+
+	files, _ := imageStorage.List()
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != used+".png "+fresh+".png new.png" {
+		t.Errorf("unexpected files after purging: %v", names)
+	}
+	if images, _ := imageStore.ListImages(); len(images) != 2 {
+		t.Errorf("expected two images after purging, got %d", len(images))
+	}
+}
@@ -1,19 +1,17 @@
 /*repo.go provides an interface for a data repo.
- *		At the moment this will hold some dummy data while the rest of
- *		the server is developed.
+ *		The actual storage is done by whichever PostStore, ImageStore
+ *		and RsvpStore were chosen at startup (see store.go).
  */
 package main
 
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/OneOfOne/xxhash"
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var currentID int
@@ -23,91 +21,85 @@ func init() {
 
 }
 
-// RepoCreatePost adds a new post to our data store.
-func RepoCreatePost(post Post) Post {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
+// RepoCreatePost adds a new post to our data store and returns it as
+//	stored, with a 0 or few added to its urltitle if that was taken.
+//	keyID is the key that signed for it, which goes in its first
+//	revision. A post without a status is published if it's visible and
+//	a draft if it isn't.
+func RepoCreatePost(post Post, keyID string) (Post, error) {
 	// Get the id to use
 	id := getNextID(post.URLTitle, post.Date)
 	post.ID = id
+	post.Images = imageRefs(post)
+	setStatus(&post, postStatus(post))
 
 	// Insert post
-	err := c.Insert(post)
+	post, err := postStore.InsertPost(post)
 	if err != nil {
-		log.Fatal(err)
+		return Post{}, err
+	}
+	postIndex.Update(post)
+	// The post is already there, so there's nothing to undo; if this
+	//	fails, its first edit records the version it started as.
+	if err := recordRevision(Post{}, post, keyID, 0); err != nil {
+		log.Printf("Couldn't record the first revision of post %d: %v", post.ID, err)
 	}
 
-	return post
+	return post, nil
 }
 
-// RepoUpdatePost updates the title and body in the database
-func RepoUpdatePost(postID string, post Input) error {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	// Find post, if it exists
-	var result Post
+// RepoUpdatePost updates the title and body in the database, and keeps
+//	the new version as a revision signed for by keyID. If the revision
+//	can't be recorded the error comes back, though the post has changed.
+func RepoUpdatePost(postID string, post Input, keyID string) error {
+	// Update Values, leaving the status and anything else we weren't
+	//	sent as they are in the store
 	id, _ := strconv.Atoi(postID)
-	if err := c.Find(bson.M{"id": id}).One(&result); err != nil {
-		log.Print("Couldn't extract post from DB")
-		log.Print(err)
-	}
-	var e Post
-
-	if result == e {
+	var before Post
+	result, err := postStore.UpdatePost(uint32(id), func(p *Post) error {
+		before = *p
+		p.Body = post.Body
+		p.Markdown = post.Markdown
+		p.Title = post.Title
+		p.Updated = time.Now()
+		if post.Tags != nil {
+			p.Tags = post.Tags
+		}
+		if post.ClearSchedule {
+			p.PublishAt, p.UnpublishAt = nil, nil
+		}
+		if post.PublishAt != nil {
+			p.PublishAt = post.PublishAt
+		}
+		if post.UnpublishAt != nil {
+			p.UnpublishAt = post.UnpublishAt
+		}
+		p.Images = imageRefs(*p)
+		return checkSchedule(p.PublishAt, p.UnpublishAt)
+	})
+	if err == ErrNotFound {
 		return fmt.Errorf("Could not find Post with ID of %s to update", postID)
 	}
-
-	// Update Values
-	if err := c.Update(result,
-		bson.M{"$set": bson.M{
-			"body":     post.Body,
-			"markdown": post.Markdown,
-			"title":    post.Title,
-			"updated":  time.Now(),
-		}}); err != nil {
+	if err != nil {
 		log.Print("Could not update post")
 		return err
 	}
+	postIndex.Update(result)
+	if err := recordRevision(before, result, keyID, 0); err != nil {
+		log.Print("Could not record the revision")
+		return err
+	}
 
 	return nil
 }
 
 // RepoURLTitleExists checks if a urltitle is already in use and returns a boolean to that effect.
 func RepoURLTitleExists(urlTitle string) bool {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	count, _ := c.Find(bson.M{"urltitle": urlTitle}).Count()
-	return count >= 1
+	exists, err := postStore.URLTitleExists(urlTitle)
+	if err != nil {
+		log.Print(err)
+	}
+	return exists
 }
 
 // getNextID returns the ID for a post added at this moment.
@@ -120,23 +112,11 @@ func getNextID(title string, date time.Time) uint32 {
 	return h.Sum32()
 }
 
-// RepoGetPost returns the post for the given ID (if one exists). If
-//	not, return a blank post.
+// RepoGetPost returns the post for the given ID (if one exists and is
+//	public). If not, return a blank post.
 func RepoGetPost(urltitle string) Post {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	var post Post
-	if err := c.Find(bson.M{"urltitle": urltitle}).One(&post); err != nil || !post.Visible {
+	post, err := postStore.PostByURLTitle(urltitle)
+	if err != nil || !post.Public(time.Now()) {
 		log.Print("Post not found!")
 		log.Print(err)
 		return Post{}
@@ -145,251 +125,138 @@ func RepoGetPost(urltitle string) Post {
 	return post
 }
 
-// RepoTogglePost toggles visibility of a post.
+// RepoTogglePost toggles visibility of a post: published posts are
+//	archived, and anything else is published.
 func RepoTogglePost(postID string) error {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	// Find post, if it exists
-	var post Post
+	// Toggle visibility
 	id, _ := strconv.Atoi(postID)
-	if err := c.Find(bson.M{"id": id}).One(&post); err != nil {
-		log.Print(err)
-	}
-	var e Post
-
-	if post == e {
+	post, err := postStore.UpdatePost(uint32(id), func(p *Post) error {
+		if postStatus(*p) == StatusPublished {
+			setStatus(p, StatusArchived)
+		} else {
+			setStatus(p, StatusPublished)
+		}
+		return nil
+	})
+	if err == ErrNotFound {
 		return fmt.Errorf("Could not find Post with ID of %s to delete", postID)
 	}
-
-	// Toggle visibility
-	if err := c.Update(post, bson.M{"$set": bson.M{"visible": !post.Visible}}); err != nil {
+	if err != nil {
 		log.Print(err)
 		return fmt.Errorf("Could not update post")
 	}
+	postIndex.Update(post)
 
 	return nil
 }
 
-// RepoGetVisiblePosts returns a list of all visible posts (publc)
-func RepoGetVisiblePosts() Posts {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	var posts Posts
-	err := c.Find(bson.M{"visible": true}).All(&posts)
+// RepoFindPosts returns the page of posts (all of them, or only the
+//	public ones) that the query asks for, and the cursor for the next.
+func RepoFindPosts(visibleOnly bool, q PostQuery) (Posts, string, error) {
+	posts, err := postStore.ListPosts(visibleOnly)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
-
-	return posts
+	if visibleOnly {
+		posts = publicPosts(posts, time.Now())
+	}
+	page, next := q.Page(posts)
+	return page, next, nil
 }
 
-// RepoAddImage adds a new image to the database
-func RepoAddImage(filename string, extension string, shortname string) Image {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
+// RepoGetVisiblePosts returns a list of all visible posts (publc) that
+//	are past their publishing time and not yet past their unpublishing
+//	time.
+func RepoGetVisiblePosts() (Posts, error) {
+	posts, err := postStore.ListPosts(true)
+	if err != nil {
+		return nil, err
+	}
 
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux, "images")
-	c := <-ch1
+	return publicPosts(posts, time.Now()), nil
+}
 
+// RepoAddImage adds a new image to the database. The image's file is
+//	named after its ID.
+func RepoAddImage(id string, extension string, shortname string, width int, height int, variants []ImageVariant) (Image, error) {
 	// Create the Image
 	img := Image{
-		Filename: filename + extension,
+		ID:       id,
+		Filename: id + extension,
 		Title:    shortname,
 		AltText:  shortname,
-		URL:      "https://nicocourts.com/img/" + filename + extension,
+		URL:      imageStorage.URL(id + extension),
 		Date:     time.Now(),
+		Width:    width,
+		Height:   height,
+		Variants: variants,
 	}
 
-	// Insert post
-	err := c.Insert(img)
-	if err != nil {
-		log.Fatal(err)
+	// Insert image
+	if err := imageStore.InsertImage(img); err != nil {
+		return Image{}, err
 	}
 
-	return img
+	return img, nil
 }
 
-// RepoDeleteImage removes an image from the dastabase.
-func RepoDeleteImage(dateStr string) error {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux, "images")
-	c := <-ch1
+// RepoDeleteImage removes an image and its files. The record goes first
+//	so nobody is handed an image that's on its way out; if the file can't
+//	be removed the record is put back, so an image is never left without
+//	its file. Variants are only copies, so failing to delete one just
+//	gets logged.
+func RepoDeleteImage(id string) error {
+	img, err := imageStore.ImageByID(id)
+	if err != nil {
+		return err
+	}
+	if err := imageStore.DeleteImage(id); err != nil {
+		return err
+	}
 
-	err := c.Remove(bson.M{"date": dateStr})
-	return err
+	if err := imageStorage.Delete(img.Filename); err != nil && err != ErrNotFound {
+		if err := imageStore.InsertImage(img); err != nil {
+			log.Printf("Couldn't restore image %s after a failed delete: %v", id, err)
+		}
+		return fmt.Errorf("couldn't delete %s: %v", img.Filename, err)
+	}
+	removeVariants(img.Variants)
+	return nil
 }
 
-// RepoGetImage gets a single image from its dateString
-func RepoGetImage(dateStr string) (Image, error) {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux, "images")
-	c := <-ch1
-
-	img := Image{}
-	err := c.Find(bson.M{"date": dateStr}).One(&img)
-	return img, err
+// RepoGetImage gets a single image by its ID
+func RepoGetImage(id string) (Image, error) {
+	return imageStore.ImageByID(id)
 }
 
-// RepoGetImageList returns a list of all available images with urls and friendly names
-func RepoGetImageList() Images {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux, "images")
-	c := <-ch1
-
-	var images Images
-	if err := c.Find(bson.M{}).All(&images); err != nil {
-		log.Fatal(err)
-	}
-
-	return images
+// RepoSaveImage stores changes to an image's details.
+func RepoSaveImage(img Image) error {
+	return imageStore.SaveImage(img)
 }
 
-// RepoGetAllPosts returns a list of all visible posts (publc)
-func RepoGetAllPosts() Posts {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelper(ch1, &mux)
-	c := <-ch1
-
-	var posts Posts
-	err := c.Find(bson.M{}).All(&posts)
+// RepoFindImages returns the images that pass the filter, newest first.
+func RepoFindImages(filter ImageFilter) (Images, error) {
+	images, err := imageStore.ListImages()
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	return posts
-}
-
-// databaseHelper does the work of opening the database
-func databaseHelper(c1 chan *mgo.Collection, mux *sync.Mutex, table ...string) {
-	//Parse optional argument
-	if len(table) == 0 {
-		table = append(table, "posts")
+		return nil, err
 	}
 
-	//Set up DB connection
-	s := "mongodb:27017" //prod
-	//s := "localhost:27017" //dev
-
-	session, err := mgo.Dial(s)
-	if err != nil {
-		panic(err)
+	found := Images{}
+	for _, img := range images {
+		if filter.Match(img) {
+			found = append(found, img)
+		}
 	}
-	defer session.Close()
-
-	// Choose database and collection
-	conn := session.DB("postDB").C(table[0])
-
-	// Send back connection.
-	c1 <- conn
-	// Wait for the mutex to unlock before quitting
-	mux.Lock()
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Date.After(found[j].Date) })
+	return found, nil
 }
 
 /////////////////////////////////////////////////////////////
 
-// databaseHelperRSVP does the work of opening the database
-func databaseHelperRSVP(c1 chan *mgo.Collection, mux *sync.Mutex, table ...string) {
-	//Parse optional argument
-	if len(table) == 0 {
-		table = append(table, "posts")
-	}
-
-	//Set up DB connection
-	s := "mongodb:27017"
-	if devmode {
-		s = "localhost:27017" //dev
-	}
-	session, err := mgo.Dial(s) //production
-
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	// Choose database and collection
-	conn := session.DB("rsvpDB").C(table[0])
-
-	// Send back connection.
-	c1 <- conn
-	// Wait for the mutex to unlock before quitting
-	mux.Lock()
-}
-
 // RepoGetRSVP returns the post for the given ID (if one exists). If
 //	not, return a blank post.
 func RepoGetRSVP(rescode string) Rsvp {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelperRSVP(ch1, &mux)
-	c := <-ch1
-
-	var rsvp Rsvp
-	err := c.Find(bson.M{"shortcode": rescode}).One(&rsvp)
+	rsvp, err := rsvpStore.RSVPByShortCode(rescode)
 	if err != nil {
 		log.Print("Post not found!")
 		return Rsvp{}
@@ -400,26 +267,9 @@ func RepoGetRSVP(rescode string) Rsvp {
 
 // RepoUpdateRSVP updates an RSVP
 func RepoUpdateRSVP(rescode string, attending string, mon int, sun int) error {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelperRSVP(ch1, &mux)
-	c := <-ch1
-
 	// Update values
 	att := (attending == "true")
-	err := c.Update(bson.M{"shortcode": rescode}, bson.M{"$set": bson.M{
-		"attending":  att,
-		"updated":    true,
-		"monconfirm": mon,
-		"sunconfirm": sun,
-	}})
+	err := rsvpStore.UpdateRSVP(rescode, att, mon, sun)
 
 	if err != nil {
 		log.Print("Update failed")
@@ -428,26 +278,3 @@ func RepoUpdateRSVP(rescode string, attending string, mon int, sun int) error {
 
 	return err
 }
-
-/*// RepoGetRSVPs does its job
-func RepoGetRSVPs() []Rsvp {
-	// Create channel and mutex
-	ch1 := make(chan *mgo.Collection)
-	var mux sync.Mutex
-
-	// Prepare mutex to hold connection open until we're done with it.
-	mux.Lock()
-	defer mux.Unlock()
-
-	// Open the connection and catch the incoming pointer
-	go databaseHelperRSVP(ch1, &mux)
-	c := <-ch1
-
-	var rsvps []Rsvp
-	err := c.Find(bson.M{}).All(&rsvps)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return rsvps
-}*/
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Revision is one version of a post, stored every time the post is
+//	created, edited or restored. KeyID is the key that signed the
+//	change, and RestoredFrom the revision it rolled the post back to.
+type Revision struct {
+	PostID       uint32    `json:"postid"`
+	Number       int       `json:"number"`
+	Title        string    `json:"title"`
+	Body         string    `json:"body"`
+	Markdown     string    `json:"markdown"`
+	Tags         []string  `json:"tags,omitempty"`
+	Date         time.Time `json:"date"`
+	KeyID        string    `json:"keyid,omitempty"`
+	RestoredFrom int       `json:"restoredfrom,omitempty"`
+}
+
+// RevisionSummary is a revision without its content, for listings.
+type RevisionSummary struct {
+	Number       int       `json:"number"`
+	Title        string    `json:"title"`
+	Date         time.Time `json:"date"`
+	KeyID        string    `json:"keyid,omitempty"`
+	RestoredFrom int       `json:"restoredfrom,omitempty"`
+}
+
+// Summary returns the revision without its content.
+func (r Revision) Summary() RevisionSummary {
+	return RevisionSummary{r.Number, r.Title, r.Date, r.KeyID, r.RestoredFrom}
+}
+
+// recordRevision stores the post as it is now as its next revision.
+//	Posts from before revisions were kept get their first one the first
+//	time they change, from whatever they were before; it's the caller's
+//	job to pass that in as before.
+func recordRevision(before Post, post Post, keyID string, restoredFrom int) error {
+	if before.ID != 0 {
+		if _, err := revisionStore.RevisionByNumber(post.ID, 1); err == ErrNotFound {
+			date := before.Updated
+			if date.IsZero() {
+				date = before.Date
+			}
+			first := Revision{before.ID, 1, before.Title, before.Body, before.Markdown, before.Tags, date, "", 0}
+			// Someone else changing the post at the same time may beat us to it
+			if err := revisionStore.InsertRevision(first); err != nil && err != ErrExists {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	rev := Revision{post.ID, 0, post.Title, post.Body, post.Markdown, post.Tags, post.Updated, keyID, restoredFrom}
+	if rev.Date.IsZero() {
+		rev.Date = time.Now()
+	}
+	_, err := revisionStore.AppendRevision(rev)
+	return err
+}
+
+// RepoPostRevisions returns the revisions of a post, oldest first.
+func RepoPostRevisions(postID uint32) ([]Revision, error) {
+	if _, err := postStore.PostByID(postID); err != nil {
+		return nil, err
+	}
+	return revisionStore.Revisions(postID)
+}
+
+// RepoGetRevision returns one revision of a post.
+func RepoGetRevision(postID uint32, number int) (Revision, error) {
+	return revisionStore.RevisionByNumber(postID, number)
+}
+
+// RepoRestoreRevision rolls a post back to one of its revisions. That
+//	doesn't undo anything: the restored version becomes the newest
+//	revision.
+func RepoRestoreRevision(postID uint32, number int, keyID string) (Post, error) {
+	rev, err := revisionStore.RevisionByNumber(postID, number)
+	if err != nil {
+		return Post{}, err
+	}
+
+	var before Post
+	post, err := postStore.UpdatePost(postID, func(p *Post) error {
+		before = *p
+		p.Title = rev.Title
+		p.Body = rev.Body
+		p.Markdown = rev.Markdown
+		p.Tags = rev.Tags
+		p.Updated = time.Now()
+		p.Images = imageRefs(*p)
+		return nil
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	postIndex.Update(post)
+	if err := recordRevision(before, post, keyID, number); err != nil {
+		return Post{}, err
+	}
+	return post, nil
+}
+
+// RepoDiffRevisions compares the Markdown of two revisions of a post.
+func RepoDiffRevisions(postID uint32, from int, to int) (string, error) {
+	a, err := revisionStore.RevisionByNumber(postID, from)
+	if err != nil {
+		return "", err
+	}
+	b, err := revisionStore.RevisionByNumber(postID, to)
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(fmt.Sprintf("revision %d", from), fmt.Sprintf("revision %d", to), a.Markdown, b.Markdown), nil
+}
+
+// diffContext is how many unchanged lines are shown around each change.
+const diffContext = 3
+
+// unifiedDiff compares two texts line by line, in the same format as
+//	diff -u.
+func unifiedDiff(aName string, bName string, a string, b string) string {
+	aLines, bLines := splitLines(a), splitLines(b)
+	ops := diffLines(aLines, bLines)
+
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change, and take in everything up to the last
+		//	change that's close enough to it to share its context
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first; i < len(ops) && i-last <= 2*diffContext; i++ {
+			if ops[i].kind != ' ' {
+				last = i
+			}
+		}
+		from, to := first-diffContext, last+diffContext+1
+		if from < start {
+			from = start
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		aStart, bStart, aCount, bCount := ops[from].a+1, ops[from].b+1, 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[from:to] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.line)
+			out.WriteByte('\n')
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// splitLines splits text into lines, without their line endings.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(strings.Replace(text, "\r\n", "\n", -1), "\n"), "\n")
+}
+
+// diffOp is one line of a diff: kept (' '), removed ('-') or added
+//	('+'). a and b are how many lines of each text come before it.
+type diffOp struct {
+	kind byte
+	line string
+	a, b int
+}
+
+// maxDiffLines is the most lines diffLines will look at in detail, once
+//	the unchanged lines at either end are taken off; anything bigger is
+//	shown as removed and added wholesale.
+const maxDiffLines = 2000
+
+// diffLines finds the shortest way to turn a into b, using Myers'
+//	algorithm.
+func diffLines(a []string, b []string) []diffOp {
+	var ops []diffOp
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		ops = append(ops, diffOp{' ', a[prefix], prefix, prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	aMid, bMid := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	var mid []diffOp
+	if len(aMid)+len(bMid) > maxDiffLines {
+		for i, line := range aMid {
+			mid = append(mid, diffOp{'-', line, i, 0})
+		}
+		for j, line := range bMid {
+			mid = append(mid, diffOp{'+', line, len(aMid), j})
+		}
+	} else {
+		mid = myers(aMid, bMid)
+	}
+	for _, op := range mid {
+		op.a += prefix
+		op.b += prefix
+		ops = append(ops, op)
+	}
+
+	for i := len(a) - suffix; i < len(a); i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i - len(a) + len(b)})
+	}
+	return ops
+}
+
+// myers works forwards until some path reaches the end of both texts,
+//	remembering how far along each diagonal k (x - y) it got after each
+//	number of changes d, then works back along the path it found.
+func myers(a []string, b []string) []diffOp {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] holds v for diagonals -d-1 to d+1 after d changes
+	var trace [][]int
+
+	for d, done := 0, false; !done; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			done = done || x >= n && y >= m
+		}
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+	}
+
+	var ops []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		k := x - y
+		prevX, prevY := 0, 0
+		if d > 0 {
+			prev := func(k int) int { return trace[d-1][k+d] }
+			prevK := k - 1
+			if k == -d || (k != d && prev(k-1) < prev(k+1)) {
+				prevK = k + 1
+			}
+			prevX = prev(prevK)
+			prevY = prevX - prevK
+		}
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x], x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, diffOp{'+', b[y], x, y})
+			} else {
+				x--
+				ops = append(ops, diffOp{'-', a[x], x, y})
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
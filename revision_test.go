@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\ntwelve\n"
+	b := "one\n2\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\ntwelve\nthirteen\n"
+	want := `--- a
++++ b
+@@ -1,5 +1,5 @@
+ one
+-two
++2
+ three
+ four
+ five
+@@ -10,3 +10,4 @@
+ ten
+ eleven
+ twelve
++thirteen
+`
+	if got := unifiedDiff("a", "b", a, b); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+	if got := unifiedDiff("a", "b", a, a); got != "" {
+		t.Errorf("no changes should give no diff, got\n%s", got)
+	}
+	if got := unifiedDiff("a", "b", "", "new\n"); got != "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+new\n" {
+		t.Errorf("unexpected diff from nothing:\n%s", got)
+	}
+}
+
+// TestDiffLines checks that applying random diffs gets from one text to
+//	the other.
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string('a' + rune(rng.Intn(4)))
+		}
+		return lines
+	}
+	for i := 0; i < 200; i++ {
+		a, b := randomLines(), randomLines()
+		var gotA, gotB []string
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("diff of %q and %q doesn't add up", a, b)
+		}
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Draft", Markdown: "first\n", Body: "<p>first</p>"})
+	var post Post
+	json.Unmarshal(rec.Body.Bytes(), &post)
+	id := strconv.Itoa(int(post.ID))
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Draft", Markdown: "first\nsecond\n", Body: "<p>first</p><p>second</p>"})
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Final", Markdown: "second\n", Body: "<p>second</p>"})
+
+	var revs []RevisionSummary
+	rec = sendSigned(router, key, "GET", "/post/"+id+"/revisions", nil)
+	json.Unmarshal(rec.Body.Bytes(), &revs)
+	if rec.Code != http.StatusOK || len(revs) != 3 {
+		t.Fatalf("expected three revisions, got %d %s", rec.Code, rec.Body.String())
+	}
+	for i, rev := range revs {
+		if rev.Number != i+1 || rev.KeyID != defaultKeyID {
+			t.Errorf("unexpected revision %+v", rev)
+		}
+	}
+
+	var rev Revision
+	rec = sendSigned(router, key, "GET", "/post/"+id+"/revisions/2", nil)
+	json.Unmarshal(rec.Body.Bytes(), &rev)
+	if rec.Code != http.StatusOK || rev.Markdown != "first\nsecond\n" || rev.Body != "<p>first</p><p>second</p>" {
+		t.Errorf("unexpected revision 2: %d %+v", rec.Code, rev)
+	}
+
+	var diff struct{ Diff string }
+	rec = sendSigned(router, key, "GET", "/post/"+id+"/diff?from=1&to=3", nil)
+	json.Unmarshal(rec.Body.Bytes(), &diff)
+	if rec.Code != http.StatusOK || diff.Diff != "--- revision 1\n+++ revision 3\n@@ -1,1 +1,1 @@\n-first\n+second\n" {
+		t.Errorf("unexpected diff: %d %q", rec.Code, diff.Diff)
+	}
+
+	// Restoring adds a revision rather than throwing any away
+	rec = sendSigned(router, key, "POST", "/post/"+id+"/revisions/1/restore", nil)
+	json.Unmarshal(rec.Body.Bytes(), &post)
+	if rec.Code != http.StatusOK || post.Title != "Draft" || post.Markdown != "first\n" {
+		t.Errorf("unexpected post after restoring: %d %+v", rec.Code, post)
+	}
+	if p, _ := postStore.PostByURLTitle("draft"); p.Markdown != "first\n" || p.Body != "<p>first</p>" {
+		t.Errorf("restored post not stored: %+v", p)
+	}
+	if revs, _ := RepoPostRevisions(post.ID); len(revs) != 4 || revs[3].RestoredFrom != 1 || revs[3].Markdown != "first\n" {
+		t.Errorf("unexpected revisions after restoring: %+v", revs)
+	}
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/post/" + id + "/revisions/9", http.StatusNotFound},
+		{"GET", "/post/12345/revisions", http.StatusNotFound},
+		{"GET", "/post/draft/revisions", http.StatusNotFound},
+		{"GET", "/post/" + id + "/diff?from=1&to=9", http.StatusNotFound},
+		{"GET", "/post/" + id + "/diff?from=1", http.StatusBadRequest},
+		{"POST", "/post/" + id + "/revisions/9/restore", http.StatusNotFound},
+	} {
+		if rec := sendSigned(router, key, c.method, c.path, nil); rec.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, rec.Code)
+		}
+	}
+
+	// Posts from before revisions were kept start with the version they
+	//	had until their first edit
+	old := Post{ID: 42, Title: "Old", URLTitle: "old", Markdown: "old\n", Visible: true, Date: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)}
+	postStore.InsertPost(old)
+	if err := RepoUpdatePost("42", Input{Title: "Old", Markdown: "new\n"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	revisions, _ := RepoPostRevisions(42)
+	if len(revisions) != 2 || revisions[0].Markdown != "old\n" || !revisions[0].Date.Equal(old.Date) || revisions[0].KeyID != "" || revisions[1].Markdown != "new\n" {
+		t.Errorf("unexpected revisions of an old post: %+v", revisions)
+	}
+
+	// Edits at the same time each get their own revision
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := RepoUpdatePost("42", Input{Title: "Old", Markdown: strconv.Itoa(i)}, "test"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	revisions, _ = RepoPostRevisions(42)
+	if len(revisions) != 22 {
+		t.Errorf("expected 22 revisions after 20 more edits, got %d", len(revisions))
+	}
+	for i, rev := range revisions {
+		if rev.Number != i+1 {
+			t.Errorf("revision %d is numbered %d", i+1, rev.Number)
+		}
+	}
+}
@@ -13,9 +13,9 @@ func NewRouter() *mux.Router {
 	// First catch all OPTIONS requests
 	router.Methods("OPTIONS").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,POST,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Length, X-Requested-With")
+			w.Header().Set("Access-Control-Allow-Origin", config.CORSOrigin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET,PUT,POST,PATCH,DELETE,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Content-Length, X-Requested-With, X-Signature")
 			w.WriteHeader(http.StatusOK)
 		})
 
@@ -24,6 +24,11 @@ func NewRouter() *mux.Router {
 
 		handler = route.HandlerFunc
 
+		// Check signatures before anything else gets a look
+		if route.Signed {
+			handler = Authenticate(handler, route.Name)
+		}
+
 		// Wrap the handler in a logger
 		handler = Logger(handler, route.Name)
 
@@ -4,12 +4,14 @@ import (
 	"net/http"
 )
 
-// Route is a template for a specific route
+// Route is a template for a specific route. Routes marked Signed only
+//	reach their handler with a valid signed request (see Authenticate).
 type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Signed      bool
 }
 
 // Routes is an array of Route
@@ -22,101 +24,230 @@ var routes = Routes{
 		"GET",
 		"/",
 		Index,
+		false,
 	},
 	Route{
 		"ListPosts",
 		"GET",
 		"/posts/",
 		PostIndex,
+		false,
 	},
 	Route{
 		"ListAllPosts",
 		"POST",
 		"/posts/all/",
 		AllPostIndex,
+		true,
 	},
 	Route{
 		"PostShow",
 		"GET",
 		"/post/{postID}",
 		PostShow,
+		false,
 	},
 	Route{
 		"PostCreate",
 		"POST",
 		"/post/",
 		PostCreate,
+		true,
 	},
 	Route{
 		"PostUpdate",
 		"POST",
 		"/post/{postID}",
 		PostUpdate,
+		true,
+	},
+	Route{
+		"PostRevisions",
+		"GET",
+		"/post/{postID}/revisions",
+		PostRevisions,
+		true,
+	},
+	Route{
+		"PostRevision",
+		"GET",
+		"/post/{postID}/revisions/{revision}",
+		PostRevision,
+		true,
+	},
+	Route{
+		"PostDiff",
+		"GET",
+		"/post/{postID}/diff",
+		PostDiff,
+		true,
+	},
+	Route{
+		"PostRestore",
+		"POST",
+		"/post/{postID}/revisions/{revision}/restore",
+		PostRestore,
+		true,
+	},
+	Route{
+		"PostStatus",
+		"POST",
+		"/post/{postID}/status",
+		PostStatus,
+		true,
 	},
 	Route{
 		"ToggleVisibility",
 		"POST",
 		"/post/toggle/{postID}",
 		PostToggle,
+		true,
 	},
 	Route{
 		"ReadNonce",
 		"GET",
 		"/nonce/",
 		ReadNonce,
+		false,
 	},
 	Route{
 		"UpdateNonce",
 		"GET",
 		"/nonce/update/",
 		NonceUpdate,
+		false,
 	},
 	Route{
 		"UploadImage",
 		"POST",
 		"/upload/",
 		UploadImage,
+		true,
+	},
+	Route{
+		"UploadImageFile",
+		"PUT",
+		"/upload/{filename}",
+		UploadImageFile,
+		true,
 	},
 	Route{
 		"ImageList",
 		"GET",
 		"/images/",
 		GetImageList,
+		false,
 	},
 	Route{
-		"Image",
+		"ImageFile",
+		"GET",
+		"/img/{filename}",
+		ServeImage,
+		false,
+	},
+	Route{
+		"ImageFileHead",
+		"HEAD",
+		"/img/{filename}",
+		ServeImage,
+		false,
+	},
+	Route{
+		"ImageOrphans",
+		"POST",
+		"/images/orphans/",
+		ImageOrphans,
+		true,
+	},
+	Route{
+		"ImageShow",
+		"GET",
+		"/image/{imageID}",
+		ImageShow,
+		false,
+	},
+	Route{
+		"ImageUpdate",
+		"PATCH",
+		"/image/{imageID}",
+		ImageUpdate,
+		true,
+	},
+	Route{
+		"ImageDelete",
 		"DELETE",
-		"/image/{filename}",
+		"/image/{imageID}",
 		ImageDelete,
+		true,
+	},
+	Route{
+		"DBStats",
+		"GET",
+		"/stats/db/",
+		DBStats,
+		true,
 	},
 	Route{
 		"RSSFeed",
 		"GET",
 		"/rss/",
 		GetRSSFeed,
+		false,
+	},
+	Route{
+		"Search",
+		"GET",
+		"/search",
+		SearchPosts,
+		false,
+	},
+	Route{
+		"TagList",
+		"GET",
+		"/tags/",
+		TagIndex,
+		false,
+	},
+	Route{
+		"TagPosts",
+		"GET",
+		"/tags/{tag}/posts",
+		TagPosts,
+		false,
+	},
+	Route{
+		"TagFeed",
+		"GET",
+		"/tags/{tag}/rss/",
+		GetTagFeed,
+		false,
 	},
 	/*Route{
 		"RsvpCreate",
 		"POST",
 		"/rsvp/new/",
 		CreateRSVP,
+		false,
 	},
 	Route{
 		"RsvpList",
 		"GET",
 		"/rsvp/list/",
 		ListRSVP,
+		false,
 	},
 	Route{
 		"RsvpUpdate",
 		"POST",
 		"/rsvp/{rescode}",
 		UpdateRSVP,
+		false,
 	},*/
 	Route{
 		"RsvpFetch",
 		"GET",
 		"/rsvp/{rescode}",
 		GetRSVP,
+		false,
 	},
 }
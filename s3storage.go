@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Storage keeps images in a bucket on S3 or anything that speaks its
+//	API (MinIO, Ceph, DigitalOcean Spaces and so on). Objects are
+//	addressed path-style, so the endpoint is just the server, and
+//	requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	publicURL string
+	client    *http.Client
+}
+
+func newS3Storage(cfg S3Config) (*s3Storage, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || !u.IsAbs() {
+		return nil, fmt.Errorf("S3 endpoint %q is not an absolute URL", cfg.Endpoint)
+	}
+	s := &s3Storage{
+		endpoint:  strings.TrimSuffix(cfg.Endpoint, "/"),
+		bucket:    cfg.Bucket,
+		region:    cfg.Region,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		publicURL: cfg.PublicURL,
+		client:    &http.Client{Timeout: time.Minute},
+	}
+	if s.publicURL == "" {
+		s.publicURL = s.endpoint + "/" + s.bucket + "/"
+	}
+	return s, nil
+}
+
+// Put implements ImageStorage.
+func (s *s3Storage) Put(name string, content io.ReadSeeker, contentType string) error {
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	res, err := s.do("PUT", name, nil, content, header)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Get implements ImageStorage. Images are small enough that we just read
+//	the whole object rather than going back to S3 for every range.
+func (s *s3Storage) Get(name string) (ImageFile, error) {
+	res, err := s.do("GET", name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &s3File{bytes.NewReader(data), modTime}, nil
+}
+
+// Delete implements ImageStorage. S3 doesn't say whether there was
+//	anything to delete, so this never returns ErrNotFound.
+func (s *s3Storage) Delete(name string) error {
+	res, err := s.do("DELETE", name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// URL implements ImageStorage.
+func (s *s3Storage) URL(name string) string {
+	return s.publicURL + name
+}
+
+// List implements ImageStorage.
+func (s *s3Storage) List() ([]StoredFile, error) {
+	var files []StoredFile
+	query := url.Values{"list-type": {"2"}}
+	for {
+		res, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Contents {
+			files = append(files, StoredFile{obj.Key, obj.Size, obj.LastModified})
+		}
+		if !page.IsTruncated {
+			return files, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the named object, or for the bucket if
+//	name is empty. Anything but a 2xx comes back as an error, with a 404
+//	as ErrNotFound.
+func (s *s3Storage) do(method string, name string, query url.Values, body io.ReadSeeker, header http.Header) (*http.Response, error) {
+	// Hash the body for the signature, then rewind it to send it
+	hash := sha256.New()
+	var length int64
+	if body != nil {
+		var err error
+		if length, err = io.Copy(hash, body); err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	path := "/" + s3Escape(s.bucket)
+	if name != "" {
+		path += "/" + s3Escape(name)
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	if body != nil {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = length
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, hex.EncodeToString(hash.Sum(nil)), time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, name, res.Status, msg)
+	}
+	return res, nil
+}
+
+// sign adds an AWS Signature Version 4 to req. The host, range and
+//	content type are signed along with every x-amz-* header.
+func (s *s3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" || k == "content-type" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes a path segment the way S3 expects: everything but
+//	letters, digits and -._~ is percent-encoded.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3File is an ImageFile read from S3.
+type s3File struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (f *s3File) Close() error {
+	return nil
+}
+
+func (f *s3File) ModTime() time.Time {
+	return f.modTime
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// scheduleChanges returns the posts that went public, and those that
+//	came down, in the time after from up to and including to. Posts
+//	that aren't visible don't go anywhere whatever their schedule says.
+func scheduleChanges(posts Posts, from time.Time, to time.Time) (published Posts, unpublished Posts) {
+	passed := func(t *time.Time) bool {
+		return t != nil && t.After(from) && !t.After(to)
+	}
+	for _, post := range posts {
+		if !post.Visible {
+			continue
+		}
+		if passed(post.PublishAt) && post.Public(*post.PublishAt) {
+			published = append(published, post)
+		}
+		if passed(post.UnpublishAt) {
+			unpublished = append(unpublished, post)
+		}
+	}
+	return published, unpublished
+}
+
+// WatchScheduleEvery checks every interval for scheduled posts that have
+//	gone public or come down since the last check, and logs them, until
+//	stop is closed. Nothing needs changing when they do, since whether
+//	a post is public is worked out whenever it's asked for.
+func WatchScheduleEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			posts, err := postStore.ListPosts(true)
+			if err != nil {
+				log.Print("Couldn't check the publishing schedule: ", err)
+				continue
+			}
+			published, unpublished := scheduleChanges(posts, last, now)
+			for _, post := range published {
+				log.Printf("Published post %d (%s) as scheduled", post.ID, post.URLTitle)
+			}
+			for _, post := range unpublished {
+				log.Printf("Unpublished post %d (%s) as scheduled", post.ID, post.URLTitle)
+			}
+			last = now
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleChanges(t *testing.T) {
+	now := time.Now()
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+	posts := Posts{
+		{ID: 1, Visible: true, PublishAt: at(-30 * time.Second)},
+		{ID: 2, Visible: true, PublishAt: at(-2 * time.Minute)},
+		{ID: 3, Visible: false, PublishAt: at(-30 * time.Second)},
+		{ID: 4, Visible: true, PublishAt: at(-2 * time.Minute), UnpublishAt: at(-10 * time.Second)},
+		{ID: 5, Visible: true, PublishAt: at(-30 * time.Second), UnpublishAt: at(-20 * time.Second)},
+		{ID: 6, Visible: true, PublishAt: at(time.Second)},
+		{ID: 7, Visible: true},
+	}
+	ids := func(posts Posts) string {
+		var s []string
+		for _, p := range posts {
+			s = append(s, strconv.Itoa(int(p.ID)))
+		}
+		return strings.Join(s, " ")
+	}
+
+	published, unpublished := scheduleChanges(posts, now.Add(-time.Minute), now)
+	if ids(published) != "1 5" || ids(unpublished) != "4 5" {
+		t.Errorf("got published %q, unpublished %q", ids(published), ids(unpublished))
+	}
+}
+
+func TestScheduledPosts(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	now := time.Now()
+	later, past := now.Add(time.Hour), now.Add(-time.Hour)
+	rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Coming soon", Markdown: "zanzibar", Tags: []string{"soon"}, Status: StatusPublished, PublishAt: &later})
+	var post Post
+	json.Unmarshal(rec.Body.Bytes(), &post)
+	if post.PublishAt == nil || !post.PublishAt.Equal(later) {
+		t.Fatalf("publishing time not kept: %s", rec.Body.String())
+	}
+	sendSigned(router, key, "POST", "/post/", Input{Title: "Gone", Markdown: "zanzibar", Status: StatusPublished, UnpublishAt: &past})
+
+	// Neither is anywhere to be seen yet, except in the full list
+	for _, path := range []string{"/posts/", "/rss/", "/search?q=zanzibar", "/tags/", "/tags/soon/posts"} {
+		if body := get(router, path).Body.String(); strings.Contains(body, "coming-soon") || strings.Contains(body, "soon\"") || strings.Contains(body, "gone") {
+			t.Errorf("%s shows a post that isn't public: %s", path, body)
+		}
+	}
+	if p := RepoGetPost("coming-soon"); p.ID != 0 {
+		t.Error("scheduled post shown before its time")
+	}
+	if all := sendSigned(router, key, "POST", "/posts/all/", Input{}).Body.String(); !strings.Contains(all, "coming-soon") || !strings.Contains(all, "gone") {
+		t.Errorf("full list should have scheduled posts: %s", all)
+	}
+
+	// Bringing the time forward publishes it
+	id := strconv.Itoa(int(post.ID))
+	if rec := sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Coming soon", Markdown: "zanzibar", PublishAt: &past}); rec.Code != http.StatusOK {
+		t.Fatalf("update failed: %d", rec.Code)
+	}
+	if p := RepoGetPost("coming-soon"); p.ID != post.ID {
+		t.Error("post not shown once its time has come")
+	}
+	if body := get(router, "/rss/").Body.String(); !strings.Contains(body, "coming-soon") {
+		t.Errorf("post missing from the feed: %s", body)
+	}
+
+	if rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Backwards", PublishAt: &later, UnpublishAt: &past}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an empty publishing window, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// Updates keep the times they leave out, unless told to clear them
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Coming soon", Markdown: "zanzibar", UnpublishAt: &later})
+	if p, _ := postStore.PostByID(post.ID); p.PublishAt == nil || !p.PublishAt.Equal(past) || p.UnpublishAt == nil {
+		t.Errorf("update should have kept publishat and added unpublishat: %+v", p)
+	}
+	if rec := sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Coming soon", PublishAt: &later}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an update that empties the window, got %d", http.StatusBadRequest, rec.Code)
+	}
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Coming soon", Markdown: "zanzibar", ClearSchedule: true})
+	if p, _ := postStore.PostByID(post.ID); p.PublishAt != nil || p.UnpublishAt != nil {
+		t.Errorf("schedule should have been cleared: %+v", p)
+	}
+}
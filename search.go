@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on what we'll search for.
+const (
+	maxSearchLength  = 200
+	maxSearchClauses = 10
+	snippetLength    = 200
+)
+
+// The parts of a post we search, and how much a match in each counts.
+const (
+	fieldTitle = iota
+	fieldMarkdown
+	fieldBody
+	numFields
+)
+
+var fieldWeights = [numFields]float64{3, 1, 1}
+
+// htmlTagPattern matches the tags in a post body, which aren't searched.
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// searchToken is a word in a post, and where it is in the field's text.
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+// searchField is one searchable part of a post.
+type searchField struct {
+	text   string
+	tokens []searchToken
+}
+
+// searchDoc is a post as the index sees it.
+type searchDoc struct {
+	post   Post
+	fields [numFields]searchField
+}
+
+// searchIndex is an inverted index of every post: for each word, the
+//	posts it appears in. Posts are indexed whether they're visible or
+//	not, so they don't have to be reindexed just to show or hide them.
+type searchIndex struct {
+	mu    sync.RWMutex
+	docs  map[uint32]*searchDoc
+	terms map[string]map[uint32]bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{docs: make(map[uint32]*searchDoc), terms: make(map[string]map[uint32]bool)}
+}
+
+// postIndex is the index behind /search. It's filled by
+//	RepoRebuildSearchIndex at startup and kept up to date by the Repo
+//	functions that change posts.
+var postIndex = newSearchIndex()
+
+// tokenize splits text into lowercase words.
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text + " " {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			tokens = append(tokens, searchToken{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// Update adds post to the index, or replaces what the index had for it.
+func (idx *searchIndex) Update(post Post) {
+	doc := &searchDoc{post: post}
+	body := html.UnescapeString(htmlTagPattern.ReplaceAllString(post.Body, " "))
+	for f, text := range [numFields]string{post.Title, post.Markdown, body} {
+		doc.fields[f] = searchField{text, tokenize(text)}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(post.ID)
+	idx.docs[post.ID] = doc
+	for _, field := range doc.fields {
+		for _, tok := range field.tokens {
+			if idx.terms[tok.term] == nil {
+				idx.terms[tok.term] = make(map[uint32]bool)
+			}
+			idx.terms[tok.term][post.ID] = true
+		}
+	}
+}
+
+// Reset empties the index.
+func (idx *searchIndex) Reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.docs = make(map[uint32]*searchDoc)
+	idx.terms = make(map[string]map[uint32]bool)
+}
+
+// remove takes a post out of the index. The caller holds the lock.
+func (idx *searchIndex) remove(id uint32) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, field := range doc.fields {
+		for _, tok := range field.tokens {
+			delete(idx.terms[tok.term], id)
+			if len(idx.terms[tok.term]) == 0 {
+				delete(idx.terms, tok.term)
+			}
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// searchClause is one part of a query: a word, the start of a word
+//	(written word*), or a phrase (written in double quotes).
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearchQuery splits a query into clauses, every one of which a
+//	post has to match.
+func parseSearchQuery(q string) ([]searchClause, error) {
+	if len(q) > maxSearchLength {
+		return nil, errors.New("search is too long")
+	}
+
+	var clauses []searchClause
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			// Inside quotes
+			var terms []string
+			for _, tok := range tokenize(part) {
+				terms = append(terms, tok.term)
+			}
+			if len(terms) > 0 {
+				clauses = append(clauses, searchClause{terms: terms})
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			prefix := strings.HasSuffix(word, "*")
+			before := len(clauses)
+			for _, tok := range tokenize(word) {
+				clauses = append(clauses, searchClause{terms: []string{tok.term}})
+			}
+			// A * on its own doesn't make the word before it a prefix
+			if prefix && len(clauses) > before {
+				clauses[len(clauses)-1].prefix = true
+			}
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, errors.New("nothing to search for")
+	}
+	if len(clauses) > maxSearchClauses {
+		return nil, errors.New("too many words to search for")
+	}
+	return clauses, nil
+}
+
+// matches finds where the clause matches in a field, as token ranges.
+func (c searchClause) matches(field searchField) [][2]int {
+	var found [][2]int
+	tokens := field.tokens
+	for i := 0; i+len(c.terms) <= len(tokens); i++ {
+		ok := true
+		for j, term := range c.terms {
+			last := j == len(c.terms)-1
+			if tokens[i+j].term != term && !(last && c.prefix && strings.HasPrefix(tokens[i+j].term, term)) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			found = append(found, [2]int{i, i + len(c.terms)})
+		}
+	}
+	return found
+}
+
+// candidates returns the posts that might match the clause, going by
+//	the words they contain. The caller holds the lock.
+func (idx *searchIndex) candidates(c searchClause) map[uint32]bool {
+	if !c.prefix || len(c.terms) > 1 {
+		return idx.terms[c.terms[0]]
+	}
+	ids := make(map[uint32]bool)
+	for term, posts := range idx.terms {
+		if strings.HasPrefix(term, c.terms[0]) {
+			for id := range posts {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// SearchResult is a post that matched a search, with a bit of it showing
+//	where.
+type SearchResult struct {
+	Post    PostSummary `json:"post"`
+	Score   float64     `json:"score"`
+	Snippet string      `json:"snippet"`
+}
+
+// Search finds the posts matching every clause and that keep says to
+//	keep, best match first.
+func (idx *searchIndex) Search(clauses []searchClause, keep func(Post) bool) []SearchResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Narrow things down with the rarest clause. How rare each one is
+	//	also goes into the score.
+	var ids map[uint32]bool
+	docFreq := make([]int, len(clauses))
+	for i, c := range clauses {
+		cand := idx.candidates(c)
+		if ids == nil || len(cand) < len(ids) {
+			ids = cand
+		}
+		docFreq[i] = len(cand)
+	}
+
+	type hit struct {
+		doc   *searchDoc
+		found [][numFields][][2]int
+	}
+	var hits []hit
+	for id := range ids {
+		doc := idx.docs[id]
+		if !keep(doc.post) {
+			continue
+		}
+		h := hit{doc, make([][numFields][][2]int, len(clauses))}
+		for i, c := range clauses {
+			matched := false
+			for f := range doc.fields {
+				h.found[i][f] = c.matches(doc.fields[f])
+				matched = matched || len(h.found[i][f]) > 0
+			}
+			if !matched {
+				h.doc = nil
+				break
+			}
+		}
+		if h.doc != nil {
+			hits = append(hits, h)
+		}
+	}
+
+	// Rarer clauses count for more, and each extra match in a field
+	//	counts for a little less than the last
+	results := make([]SearchResult, 0, len(hits))
+	for _, h := range hits {
+		score := 0.0
+		for i := range clauses {
+			idf := math.Log(1 + float64(len(idx.docs))/float64(docFreq[i]))
+			for f, found := range h.found[i] {
+				tf := float64(len(found))
+				score += idf * fieldWeights[f] * tf / (tf + 1.2)
+			}
+		}
+		results = append(results, SearchResult{h.doc.post.Summary(), math.Round(score*1000) / 1000, snippet(h.doc, h.found)})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Post.Date.After(results[j].Post.Date)
+	})
+	return results
+}
+
+// snippet picks the first match in the post's text (or its title if
+//	that's the only place it matched) and returns the text around it as
+//	HTML, with every match in it wrapped in <mark>.
+func snippet(doc *searchDoc, found [][numFields][][2]int) string {
+	for _, f := range []int{fieldMarkdown, fieldBody, fieldTitle} {
+		var spans [][2]int
+		for _, clause := range found {
+			spans = append(spans, clause[f]...)
+		}
+		if len(spans) == 0 {
+			continue
+		}
+		sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+		field := doc.fields[f]
+		first, firstEnd := field.tokens[spans[0][0]].start, field.tokens[spans[0][1]-1].end
+		start := first - snippetLength/4
+		if start > len(field.text)-snippetLength {
+			start = len(field.text) - snippetLength
+		}
+		if start < 0 {
+			start = 0
+		}
+		end := start + snippetLength
+		if end < firstEnd {
+			end = firstEnd
+		}
+		if end > len(field.text) {
+			end = len(field.text)
+		}
+		// Don't cut words (or characters) in half
+		for start > 0 && start < first && isWordByte(field.text, start-1) {
+			start++
+		}
+		for end < len(field.text) && end > firstEnd && isWordByte(field.text, end) {
+			end--
+		}
+
+		var b strings.Builder
+		if start > 0 {
+			b.WriteString("…")
+		}
+		pos := start
+		for _, span := range spans {
+			from, to := field.tokens[span[0]].start, field.tokens[span[1]-1].end
+			if from < pos || to > end {
+				continue
+			}
+			b.WriteString(html.EscapeString(field.text[pos:from]))
+			b.WriteString("<mark>" + html.EscapeString(field.text[from:to]) + "</mark>")
+			pos = to
+		}
+		b.WriteString(html.EscapeString(field.text[pos:end]))
+		if end < len(field.text) {
+			b.WriteString("…")
+		}
+		return strings.Join(strings.Fields(b.String()), " ")
+	}
+	return ""
+}
+
+// isWordByte reports whether the byte at i is part of a word (or of a
+//	multi-byte character).
+func isWordByte(s string, i int) bool {
+	if s[i] >= utf8.RuneSelf {
+		return true
+	}
+	r := rune(s[i])
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// RepoRebuildSearchIndex indexes every post from scratch.
+func RepoRebuildSearchIndex() error {
+	posts, err := postStore.ListPosts(false)
+	if err != nil {
+		return err
+	}
+	postIndex.Reset()
+	for _, post := range posts {
+		postIndex.Update(post)
+	}
+	return nil
+}
+
+// RepoSearchPosts searches the public posts, and returns the page of
+//	results starting at offset along with how many there are in all.
+func RepoSearchPosts(q string, offset int, limit int) ([]SearchResult, int, error) {
+	clauses, err := parseSearchQuery(q)
+	if err != nil {
+		return nil, 0, err
+	}
+	now := time.Now()
+	results := postIndex.Search(clauses, func(p Post) bool { return p.Public(now) })
+	total := len(results)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		results = results[offset : offset+limit]
+	} else {
+		results = results[offset:]
+	}
+	return results, total, nil
+}
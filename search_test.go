@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	clauses, err := parseSearchQuery(`Yoneda "natural  Transformation" funct* - lemma * "colimit"*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range clauses {
+		s := strings.Join(c.terms, " ")
+		if c.prefix {
+			s += "*"
+		}
+		got = append(got, s)
+	}
+	if strings.Join(got, "|") != "yoneda|natural transformation|funct*|lemma|colimit" {
+		t.Errorf("unexpected clauses %q", got)
+	}
+
+	for _, bad := range []string{"", `"" * -`, strings.Repeat("a ", maxSearchClauses+1), strings.Repeat("a", maxSearchLength+1)} {
+		if _, err := parseSearchQuery(bad); err == nil {
+			t.Errorf("%q should be refused", bad)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RepoRebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	now := time.Now()
+	RepoCreatePost(Post{Title: "The Yoneda lemma", URLTitle: "yoneda", Visible: true, Date: now,
+		Markdown: "Every functor is a colimit of representables, by the *Yoneda* lemma.",
+		Body:     "<p>Every functor is a colimit of representables, by the <em>Yoneda</em> lemma.</p>"}, "")
+	RepoCreatePost(Post{Title: "Natural transformations", URLTitle: "natural", Visible: true, Date: now.Add(-time.Hour),
+		Markdown: "A natural transformation between functors. See also Yoneda & friends.",
+		Body:     "<p>A natural transformation between functors. See also Yoneda &amp; friends.</p>"}, "")
+	RepoCreatePost(Post{Title: "Groceries", URLTitle: "groceries", Visible: true, Date: now.Add(-2 * time.Hour),
+		Markdown: "Buy " + strings.Repeat("milk and eggs, ", 30) + "and transformation-proof bread."}, "")
+	hidden, _ := RepoCreatePost(Post{Title: "Draft about Yoneda", URLTitle: "draft", Date: now, Markdown: "Yoneda again"}, "")
+
+	search := func(query string) (int, http.Header, []SearchResult) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/search?"+query, nil))
+		var results []SearchResult
+		json.Unmarshal(rec.Body.Bytes(), &results)
+		return rec.Code, rec.Header(), results
+	}
+	titles := func(results []SearchResult) string {
+		var t []string
+		for _, r := range results {
+			t = append(t, r.Post.URLTitle)
+		}
+		return strings.Join(t, " ")
+	}
+
+	for q, want := range map[string]string{
+		"yoneda":                     "yoneda natural",
+		"YONEDA lemma":               "yoneda",
+		`"natural transformation"`:   "natural",
+		`"transformation natural"`:   "",
+		"funct*":                     "yoneda natural",
+		"transformation":             "natural groceries",
+		"friends":                    "natural",
+		"nothing-like-this-anywhere": "",
+	} {
+		code, _, results := search("q=" + url.QueryEscape(q))
+		if code != http.StatusOK || titles(results) != want {
+			t.Errorf("search %q: got %d %q, expected %q", q, code, titles(results), want)
+		}
+	}
+
+	// Snippets show the matches, and only escaped text
+	_, _, results := search("q=" + url.QueryEscape(`yoneda friends`))
+	if len(results) != 1 || results[0].Snippet != "A natural transformation between functors. See also <mark>Yoneda</mark> &amp; <mark>friends</mark>." {
+		t.Errorf("unexpected snippet %+v", results)
+	}
+	_, _, results = search("q=bread")
+	if len(results) != 1 || !strings.HasPrefix(results[0].Snippet, "…") || !strings.HasSuffix(results[0].Snippet, "transformation-proof <mark>bread</mark>.") {
+		t.Errorf("long posts should be cut down around the match: %+v", results)
+	}
+	if len(results) == 1 && len(results[0].Snippet) > snippetLength+20 {
+		t.Errorf("snippet is %d bytes long", len(results[0].Snippet))
+	}
+
+	// The index keeps up with changes
+	if err := RepoTogglePost(strconv.Itoa(int(hidden.ID))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, results := search("q=draft"); titles(results) != "draft" {
+		t.Errorf("post shown after toggling isn't found: %q", titles(results))
+	}
+	if err := RepoUpdatePost(strconv.Itoa(int(hidden.ID)), Input{Title: "Finished", Markdown: "Done now"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, results := search("q=draft"); len(results) != 0 {
+		t.Errorf("old words still found after updating: %q", titles(results))
+	}
+	postIndex.Reset()
+	if err := RepoRebuildSearchIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, results := search("q=finished"); titles(results) != "draft" {
+		t.Errorf("post not found after rebuilding the index: %q", titles(results))
+	}
+
+	// Paging
+	code, header, results := search("q=funct*&limit=1")
+	if code != http.StatusOK || len(results) != 1 || header.Get("X-Total-Count") != "2" || header.Get("Link") != `</search?limit=1&offset=1&q=funct%2A>; rel="next"` {
+		t.Errorf("first page: got %d %v %v", code, header, titles(results))
+	}
+	code, header, results = search("q=funct*&limit=1&offset=1")
+	if code != http.StatusOK || titles(results) != "natural" || header.Get("Link") != "" {
+		t.Errorf("second page: got %d %v %v", code, header, titles(results))
+	}
+	for _, query := range []string{"q=", "q=a&limit=0", "q=a&offset=-1"} {
+		if code, _, _ := search(query); code != http.StatusBadRequest {
+			t.Errorf("search %s: expected %d, got %d", query, http.StatusBadRequest, code)
+		}
+	}
+}
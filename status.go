@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// The states a post goes through. Only published posts are visible, and
+//	so only they (and then only inside their publishing window) are
+//	ever shown to the public.
+const (
+	StatusDraft     = "draft"
+	StatusReview    = "review"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+// statusTransitions lists the states each state can move to.
+var statusTransitions = map[string][]string{
+	StatusDraft:     {StatusReview, StatusPublished, StatusArchived},
+	StatusReview:    {StatusDraft, StatusPublished},
+	StatusPublished: {StatusArchived},
+	StatusArchived:  {StatusDraft, StatusPublished},
+}
+
+// ErrBadTransition is returned when a post can't move to the state it
+//	was asked to.
+var ErrBadTransition = errors.New("post can't move to that status")
+
+// validStatus reports whether status is one of the states above.
+func validStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// canTransition reports whether a post can move from one state to the
+//	other.
+func canTransition(from string, to string) bool {
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// postStatus returns the post's state. Posts from before there were
+//	states are published if they're visible and drafts if they aren't.
+func postStatus(p Post) string {
+	if p.Status != "" {
+		return p.Status
+	}
+	if p.Visible {
+		return StatusPublished
+	}
+	return StatusDraft
+}
+
+// setStatus moves the post to a state, keeping Visible in step.
+func setStatus(p *Post, status string) {
+	p.Status = status
+	p.Visible = status == StatusPublished
+}
+
+// RepoSetPostStatus moves a post to another state, if it's allowed to go
+//	there from the one it's in.
+func RepoSetPostStatus(postID string, status string) (Post, error) {
+	id, err := strconv.ParseUint(postID, 10, 32)
+	if err != nil {
+		return Post{}, ErrNotFound
+	}
+	if !validStatus(status) {
+		return Post{}, fmt.Errorf("unknown status %q", status)
+	}
+	post, err := postStore.UpdatePost(uint32(id), func(p *Post) error {
+		if !canTransition(postStatus(*p), status) {
+			return ErrBadTransition
+		}
+		setStatus(p, status)
+		p.Updated = time.Now()
+		return nil
+	})
+	if err != nil {
+		return Post{}, err
+	}
+	postIndex.Update(post)
+	return post, nil
+}
+
+// RepoFillPostStatus gives the posts from before there were states the
+//	one they'd have had. It runs at startup.
+func RepoFillPostStatus() error {
+	posts, err := postStore.ListPosts(false)
+	if err != nil {
+		return err
+	}
+
+	changed := 0
+	for _, post := range posts {
+		if post.Status != "" {
+			continue
+		}
+		_, err := postStore.UpdatePost(post.ID, func(p *Post) error {
+			if p.Status == "" {
+				setStatus(p, postStatus(*p))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		changed++
+	}
+	if changed > 0 {
+		log.Printf("Set the status of %d posts", changed)
+	}
+	return nil
+}
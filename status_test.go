@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPostStatus(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	// New posts start out as drafts, which the public never sees
+	rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Work in progress", Body: "<p>wip</p>"})
+	var post Post
+	json.Unmarshal(rec.Body.Bytes(), &post)
+	if post.Status != StatusDraft || post.Visible {
+		t.Fatalf("new post should be a hidden draft: %s", rec.Body.String())
+	}
+	id := strconv.Itoa(int(post.ID))
+	for _, path := range []string{"/posts/", "/post/work-in-progress", "/rss/"} {
+		if body := get(router, path).Body.String(); strings.Contains(body, "wip") {
+			t.Errorf("%s shows a draft: %s", path, body)
+		}
+	}
+	if body := sendSigned(router, key, "POST", "/posts/all/?status=draft", Input{}).Body.String(); !strings.Contains(body, "work-in-progress") {
+		t.Errorf("draft missing from the admin list: %s", body)
+	}
+	if body := sendSigned(router, key, "POST", "/posts/all/?status=published", Input{}).Body.String(); strings.Contains(body, "work-in-progress") {
+		t.Errorf("draft listed as published: %s", body)
+	}
+
+	for _, c := range []struct {
+		status string
+		code   int
+	}{
+		{StatusReview, http.StatusOK},
+		{StatusArchived, http.StatusConflict},
+		{"finished", http.StatusBadRequest},
+		{StatusPublished, http.StatusOK},
+		{StatusReview, http.StatusConflict},
+	} {
+		if rec := sendSigned(router, key, "POST", "/post/"+id+"/status", StatusChange{c.status}); rec.Code != c.code {
+			t.Errorf("moving to %s: expected %d, got %d %s", c.status, c.code, rec.Code, rec.Body.String())
+		}
+	}
+	if p := RepoGetPost("work-in-progress"); p.Status != StatusPublished || !p.Visible {
+		t.Errorf("post not published: %+v", p)
+	}
+	if body := get(router, "/rss/").Body.String(); !strings.Contains(body, "wip") {
+		t.Errorf("published post missing from the feed: %s", body)
+	}
+	if rec := sendSigned(router, key, "POST", "/post/12345/status", StatusChange{StatusDraft}); rec.Code != http.StatusNotFound {
+		t.Errorf("expected %d for a missing post, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// Toggling archives published posts and publishes anything else
+	RepoTogglePost(id)
+	if p, _ := postStore.PostByID(post.ID); p.Status != StatusArchived || p.Visible {
+		t.Errorf("toggled post should be archived: %+v", p)
+	}
+	RepoTogglePost(id)
+	if p, _ := postStore.PostByID(post.ID); p.Status != StatusPublished || !p.Visible {
+		t.Errorf("toggled post should be published again: %+v", p)
+	}
+
+	// Posts from before there were statuses get one at startup
+	postStore.InsertPost(Post{ID: 1, URLTitle: "old-visible", Visible: true, Date: time.Now()})
+	postStore.InsertPost(Post{ID: 2, URLTitle: "old-hidden", Date: time.Now()})
+	if err := RepoFillPostStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := postStore.PostByID(1); p.Status != StatusPublished {
+		t.Errorf("visible old post should be published: %+v", p)
+	}
+	if p, _ := postStore.PostByID(2); p.Status != StatusDraft {
+		t.Errorf("hidden old post should be a draft: %+v", p)
+	}
+}
+
+func TestConcurrentPostChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, cfg := range []Config{{Store: "memory"}, {Store: "bolt", DBFile: filepath.Join(dir, "blog.db")}} {
+		if err := OpenStores(cfg); err != nil {
+			t.Fatal(err)
+		}
+		post, err := RepoCreatePost(Post{Title: "Busy", URLTitle: "busy", Status: StatusDraft, Date: time.Now()}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := strconv.Itoa(int(post.ID))
+
+		// Edits that started before the post was published mustn't
+		//	unpublish it, or lose each other's tags
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				var tags []string
+				if i == 0 {
+					tags = []string{"kept"}
+				}
+				if err := RepoUpdatePost(id, Input{Title: "Busy", Markdown: strconv.Itoa(i), Tags: tags}, ""); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := RepoSetPostStatus(id, StatusPublished); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		if p, _ := postStore.PostByID(post.ID); p.Status != StatusPublished || !p.Visible || len(p.Tags) != 1 {
+			t.Errorf("%s: a change was lost: %+v", cfg.Store, p)
+		}
+		CloseStores()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned by a store when the requested record doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrExists is returned by a store when a new record would clash with
+//	one it already has.
+var ErrExists = errors.New("already exists")
+
+// PostStore is anything that can hold on to our blog posts.
+type PostStore interface {
+	// InsertPost stores a brand new post and returns it as stored. The
+	//	ID must already be set, and ErrExists comes back if it's taken.
+	//	If the urltitle is taken, 0s are added to the end of it until it
+	//	isn't, in the same write so two posts can't end up with one.
+	InsertPost(post Post) (Post, error)
+	// UpdatePost changes the post with the given ID by calling change on
+	//	it, and returns the post as stored. change always sees the post
+	//	as it is in the store, and nobody else's change can land in
+	//	between (a store may call it again if one tried to), so it
+	//	mustn't use the store itself. If change returns an error the post
+	//	is left alone and UpdatePost returns it.
+	UpdatePost(id uint32, change func(post *Post) error) (Post, error)
+	// PostByID finds a post (visible or not) by its ID.
+	PostByID(id uint32) (Post, error)
+	// PostByURLTitle finds a post (visible or not) by its urltitle.
+	PostByURLTitle(urlTitle string) (Post, error)
+	// URLTitleExists reports whether any post already uses urlTitle.
+	URLTitleExists(urlTitle string) (bool, error)
+	// ListPosts returns every post, or only the visible ones.
+	ListPosts(visibleOnly bool) (Posts, error)
+}
+
+// ImageStore holds the metadata for uploaded images.
+type ImageStore interface {
+	// InsertImage stores a new image, or returns ErrExists if its ID is
+	//	already taken.
+	InsertImage(img Image) error
+	// ImageByID finds an image by its ID.
+	ImageByID(id string) (Image, error)
+	// SaveImage replaces the stored image having the same ID.
+	SaveImage(img Image) error
+	// DeleteImage removes the image with the given ID.
+	DeleteImage(id string) error
+	// ListImages returns every image.
+	ListImages() (Images, error)
+}
+
+// RevisionStore keeps every version of every post. Revisions are never
+//	changed once stored.
+type RevisionStore interface {
+	// InsertRevision stores a new revision, or returns ErrExists if the
+	//	post already has one with that number.
+	InsertRevision(rev Revision) error
+	// AppendRevision stores rev as its post's newest revision, numbered
+	//	one more than the last, and returns it with its number. The
+	//	number is picked in the same write, so two revisions can't get
+	//	the same one.
+	AppendRevision(rev Revision) (Revision, error)
+	// Revisions returns a post's revisions, oldest first.
+	Revisions(postID uint32) ([]Revision, error)
+	// RevisionByNumber finds one revision of a post.
+	RevisionByNumber(postID uint32, number int) (Revision, error)
+}
+
+// RsvpStore holds RSVPs for the wedding.
+type RsvpStore interface {
+	RSVPByShortCode(rescode string) (Rsvp, error)
+	UpdateRSVP(rescode string, attending bool, mon int, sun int) error
+}
+
+// The stores currently in use. These are set up by OpenStores at startup.
+var (
+	postStore     PostStore
+	imageStore    ImageStore
+	revisionStore RevisionStore
+	rsvpStore     RsvpStore
+)
+
+// statsReporter is implemented by backends with something to say about
+//	their connections.
+type statsReporter interface {
+	Stats() interface{}
+}
+
+// OpenStores sets up the storage backend named by cfg.Store ("mongo",
+//	"memory" or "bolt") and installs it for the Repo* functions to use.
+func OpenStores(cfg Config) error {
+	switch cfg.Store {
+	case "mongo":
+		s, err := openMongoStore(cfg.MongoAddr)
+		if err != nil {
+			return err
+		}
+		postStore, imageStore, revisionStore, rsvpStore = s, s, s, s
+	case "memory":
+		s := newMemoryStore()
+		postStore, imageStore, revisionStore, rsvpStore = s, s, s, s
+	case "bolt":
+		s, err := openBoltStore(cfg.DBFile)
+		if err != nil {
+			return err
+		}
+		postStore, imageStore, revisionStore, rsvpStore = s, s, s, s
+	default:
+		return fmt.Errorf("unknown storage backend %q", cfg.Store)
+	}
+	return nil
+}
+
+// StoreStats returns the current backend's connection stats, if it
+//	keeps any.
+func StoreStats() (interface{}, bool) {
+	if r, ok := postStore.(statsReporter); ok {
+		return r.Stats(), true
+	}
+	return nil, false
+}
+
+// CloseStores lets the current backend release whatever it is holding.
+func CloseStores() error {
+	if c, ok := postStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Tags are short and there aren't many on one post.
+const (
+	maxTags      = 20
+	maxTagLength = 50
+)
+
+// tagPattern is what a tag looks like once it's been normalized: words
+//	(in any script) joined by hyphens.
+var tagPattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}]+(?:-[\p{Ll}\p{Lo}\p{N}]+)*$`)
+
+// normalizeTag lowercases a tag and joins its words with hyphens, so
+//	"Category Theory" and "category-theory" are the same tag.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+	if len(tag) > maxTagLength {
+		return "", fmt.Errorf("tag %q is longer than %d bytes", tag, maxTagLength)
+	}
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("%q isn't a valid tag", tag)
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes a post's tags and drops repeats. Nil stays
+//	nil, which means "leave the tags alone" when updating a post.
+func normalizeTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag, err := normalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("posts can't have more than %d tags", maxTags)
+	}
+	return normalized, nil
+}
+
+// hasTag reports whether post is tagged with tag.
+func hasTag(post Post, tag string) bool {
+	for _, t := range post.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagCount is a tag and how many posts have it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// RepoTagCounts counts the public posts with each tag, most used first.
+func RepoTagCounts() ([]TagCount, error) {
+	posts, err := postStore.ListPosts(true)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, post := range publicPosts(posts, time.Now()) {
+		for _, tag := range post.Tags {
+			counts[tag]++
+		}
+	}
+	tags := []TagCount{}
+	for tag, n := range counts {
+		tags = append(tags, TagCount{tag, n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Count != tags[j].Count {
+			return tags[i].Count > tags[j].Count
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" Category  Theory", "category-theory", "Gödel", "math"})
+	if err != nil || strings.Join(tags, " ") != "category-theory gödel math" {
+		t.Errorf("got %v, %v", tags, err)
+	}
+	if tags, _ := normalizeTags(nil); tags != nil {
+		t.Error("no tags should stay nil")
+	}
+	if tags, _ := normalizeTags([]string{}); tags == nil {
+		t.Error("an empty list of tags should stay empty")
+	}
+	for _, bad := range [][]string{{""}, {"c++"}, {"-math"}, {"a/b"}, {strings.Repeat("x", maxTagLength+1)}} {
+		if _, err := normalizeTags(bad); err == nil {
+			t.Errorf("%q should be rejected", bad)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	key := useTestKey(t)
+	if err := OpenStores(Config{Store: "memory"}); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter()
+
+	rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Yoneda", Body: "<p>y</p>", Tags: []string{"Category Theory", "math"}, Status: StatusPublished})
+	var yoneda Post
+	json.Unmarshal(rec.Body.Bytes(), &yoneda)
+	if strings.Join(yoneda.Tags, " ") != "category-theory math" {
+		t.Fatalf("unexpected tags on new post: %v (%s)", yoneda.Tags, rec.Body.String())
+	}
+	sendSigned(router, key, "POST", "/post/", Input{Title: "Primes", Body: "<p>p</p>", Tags: []string{"math"}, Status: StatusPublished})
+	RepoCreatePost(Post{Title: "Hidden", URLTitle: "hidden", Tags: []string{"math", "secret"}, Date: time.Now()}, "")
+	if rec := sendSigned(router, key, "POST", "/post/", Input{Title: "Bad", Tags: []string{"c++"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad tag: expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// Updates without tags leave them be
+	id := strconv.Itoa(int(yoneda.ID))
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Yoneda", Body: "<p>yoneda</p>"})
+	if p := RepoGetPost("yoneda"); strings.Join(p.Tags, " ") != "category-theory math" {
+		t.Errorf("tags changed by an update without any: %v", p.Tags)
+	}
+	sendSigned(router, key, "POST", "/post/"+id, Input{Title: "Yoneda", Body: "<p>yoneda</p>", Tags: []string{"category theory"}})
+	if p := RepoGetPost("yoneda"); strings.Join(p.Tags, " ") != "category-theory" {
+		t.Errorf("tags not updated: %v", p.Tags)
+	}
+
+	var counts []TagCount
+	json.Unmarshal(get(router, "/tags/").Body.Bytes(), &counts)
+	if len(counts) != 2 || counts[0] != (TagCount{"category-theory", 1}) || counts[1] != (TagCount{"math", 1}) {
+		t.Errorf("unexpected tag counts %+v", counts)
+	}
+
+	for path, want := range map[string]string{
+		"/tags/math/posts":              "Primes",
+		"/tags/Category%20Theory/posts": "Yoneda",
+		"/tags/secret/posts":            "",
+		"/posts/?tag=math":              "Primes",
+	} {
+		var posts Posts
+		rec := get(router, path)
+		json.Unmarshal(rec.Body.Bytes(), &posts)
+		var titles []string
+		for _, p := range posts {
+			titles = append(titles, p.Title)
+		}
+		if rec.Code != http.StatusOK || strings.Join(titles, " ") != want {
+			t.Errorf("GET %s: got %d %v, expected %q", path, rec.Code, titles, want)
+		}
+	}
+	if rec := get(router, "/tags/c++/posts"); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad tag: expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = get(router, "/tags/category-theory/rss/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<title>Yoneda</title>") || strings.Contains(rec.Body.String(), "Primes") {
+		t.Errorf("unexpected tag feed: %d %s", rec.Code, rec.Body.String())
+	}
+}
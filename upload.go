@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageTypes maps the kinds of image we accept to the extension they are
+//	stored under. The type comes from the file's contents, never from the
+//	name the client gave it.
+var imageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// uploadError is an upload we turned down, along with the status code to
+//	send back.
+type uploadError struct {
+	status int
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// saveUpload streams an uploaded image into the image storage and
+//	records it. The bytes go to a temporary file while being hashed, and
+//	are only stored once they turn out to be an image that matches the
+//	signed manifest and isn't bigger than config.MaxImageSize. On the
+//	way its metadata is stripped and its variants are made (see
+//	makeVariants). An image we already have isn't stored again: its
+//	existing record comes back with existing set. Uploads we refuse
+//	come back as an *uploadError.
+func saveUpload(src io.Reader, filename string, manifest ImageManifest) (img Image, existing bool, err error) {
+	// Work out what we've been sent from the first few bytes
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return Image{}, false, &uploadError{http.StatusBadRequest, "upload is empty"}
+		}
+		return Image{}, false, &uploadError{http.StatusBadRequest, "couldn't read upload"}
+	}
+	head = head[:n]
+	mimeType := http.DetectContentType(head)
+	ext, ok := imageTypes[mimeType]
+	if !ok {
+		return Image{}, false, &uploadError{http.StatusUnsupportedMediaType, mimeType + " is not a supported image type"}
+	}
+
+	// Spool it to disk rather than holding it in memory while we read it.
+	//	The leading dot keeps it out of the image storage's listings.
+	tmp, err := ioutil.TempFile(config.uploadDir(), ".upload-")
+	if err != nil {
+		return Image{}, false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Copy one byte past the limit so we can tell when it's been crossed
+	sha, sum := sha256.New(), md5.New()
+	body := io.LimitReader(io.MultiReader(bytes.NewReader(head), src), config.MaxImageSize+1)
+	size, err := io.Copy(io.MultiWriter(tmp, sha, sum), body)
+	if err != nil {
+		return Image{}, false, &uploadError{http.StatusBadRequest, "couldn't read upload"}
+	}
+	if size > config.MaxImageSize {
+		return Image{}, false, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("images can't be bigger than %d bytes", config.MaxImageSize)}
+	}
+
+	// Make sure we got the image that was signed for
+	if err := manifest.Matches(filename, sha.Sum(nil), size); err != nil {
+		return Image{}, false, &uploadError{http.StatusBadRequest, err.Error()}
+	}
+
+	// Nothing more to do if we've seen it before, either under its ID or,
+	//	from before images had IDs, under its MD5
+	id := hex.EncodeToString(sha.Sum(nil))
+	for _, known := range []string{id, hex.EncodeToString(sum.Sum(nil))} {
+		img, err := imageStore.ImageByID(known)
+		if err == nil {
+			return img, true, nil
+		}
+		if err != ErrNotFound {
+			return Image{}, false, err
+		}
+	}
+
+	// Make it safe to publish and resize it. Both need the whole image in
+	//	memory anyway, and we know it's not too big by now.
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return Image{}, false, err
+	}
+	data, err := ioutil.ReadAll(tmp)
+	if err != nil {
+		return Image{}, false, err
+	}
+	if data, err = stripMetadata(data, mimeType); err != nil {
+		return Image{}, false, err
+	}
+	width, height, variants, err := makeVariants(data, mimeType, id)
+	if err != nil {
+		return Image{}, false, err
+	}
+
+	if err := imageStorage.Put(id+ext, bytes.NewReader(data), mimeType); err != nil {
+		removeVariants(variants)
+		return Image{}, false, err
+	}
+
+	img, err = RepoAddImage(id, ext, strings.TrimSuffix(filename, filepath.Ext(filename)), width, height, variants)
+	if err == ErrExists {
+		// Someone beat us to it. The files are the same either way, so
+		//	leave them be.
+		img, err = imageStore.ImageByID(id)
+		return img, err == nil, err
+	}
+	if err != nil {
+		imageStorage.Delete(id + ext)
+		removeVariants(variants)
+		return Image{}, false, err
+	}
+	return img, false, nil
+}
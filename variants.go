@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // so GIFs can be decoded
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // so WebP uploads can be decoded
+)
+
+// maxImagePixels is the biggest image (in pixels) we'll decode to make
+//	variants from. A small file can claim to be enormous, and decoding it
+//	would eat all our memory.
+const maxImagePixels = 50000000
+
+// jpegQuality is used for every JPEG variant.
+const jpegQuality = 82
+
+// ImageVariant is a resized copy of an image. Name is "thumb" for the
+//	thumbnail and the width (like "480w") for the others, so the variants
+//	can go straight into a srcset.
+type ImageVariant struct {
+	Name     string `json:"name"`
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+	Type     string `json:"type"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// makeVariants decodes an uploaded image and stores a thumbnail and a copy
+//	at each of the configured widths, named after the original. It
+//	returns the size the image is displayed at along with the variants.
+//	Variants are never bigger than the original, never carry metadata,
+//	and are JPEGs for JPEG uploads and PNGs for anything else (just the
+//	first frame of an animated GIF), or WebP if that is turned on and
+//	comes out smaller.
+func makeVariants(data []byte, mimeType string, name string) (int, int, []ImageVariant, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, &uploadError{http.StatusBadRequest, "couldn't decode image"}
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return 0, 0, nil, &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("images can't have more than %d pixels", maxImagePixels)}
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, &uploadError{http.StatusBadRequest, "couldn't decode image"}
+	}
+
+	// Phone photos are often stored sideways with a note to turn them
+	orientation := 1
+	if mimeType == "image/jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if orientation >= 5 {
+		width, height = height, width
+	}
+
+	type target struct {
+		name          string
+		width, height int
+	}
+	var targets []target
+	if thumb := int(config.ThumbSize); width > thumb || height > thumb {
+		if width >= height {
+			targets = append(targets, target{"thumb", thumb, scale(height, thumb, width)})
+		} else {
+			targets = append(targets, target{"thumb", scale(width, thumb, height), thumb})
+		}
+	}
+	widths, _ := config.imageWidths()
+	for _, w := range widths {
+		if w < width {
+			targets = append(targets, target{strconv.Itoa(w) + "w", w, scale(height, w, width)})
+		}
+	}
+
+	var variants []ImageVariant
+	for _, t := range targets {
+		// Scale first and turn afterwards; it's much cheaper that way
+		w, h := t.width, t.height
+		if orientation >= 5 {
+			w, h = h, w
+		}
+		scaled := image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+		encoded, ext, typ, err := encodeVariant(orient(scaled, orientation), mimeType)
+		if err != nil {
+			removeVariants(variants)
+			return 0, 0, nil, err
+		}
+		filename := name + "-" + t.name + ext
+		if err := imageStorage.Put(filename, bytes.NewReader(encoded), typ); err != nil {
+			removeVariants(variants)
+			return 0, 0, nil, err
+		}
+		variants = append(variants, ImageVariant{
+			Name:     t.name,
+			Filename: filename,
+			URL:      imageStorage.URL(filename),
+			Type:     typ,
+			Width:    t.width,
+			Height:   t.height,
+		})
+	}
+
+	return width, height, variants, nil
+}
+
+// scale returns n scaled by num/den, rounded, and at least 1.
+func scale(n, num, den int) int {
+	s := (n*num + den/2) / den
+	if s < 1 {
+		return 1
+	}
+	return s
+}
+
+// encodeVariant encodes a variant in the format that suits the original,
+//	returning the bytes, extension and MIME type.
+func encodeVariant(img image.Image, mimeType string) ([]byte, string, string, error) {
+	var buf bytes.Buffer
+	ext, typ := ".png", "image/png"
+	if mimeType == "image/jpeg" {
+		ext, typ = ".jpg", "image/jpeg"
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, "", "", err
+		}
+	} else if err := png.Encode(&buf, img); err != nil {
+		return nil, "", "", err
+	}
+
+	if config.ImageWebP {
+		var webp bytes.Buffer
+		if err := nativewebp.Encode(&webp, img, nil); err != nil {
+			return nil, "", "", err
+		}
+		if webp.Len() < buf.Len() {
+			return webp.Bytes(), ".webp", "image/webp", nil
+		}
+	}
+	return buf.Bytes(), ext, typ, nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 if it
+//	doesn't have one.
+func jpegOrientation(data []byte) int {
+	rest := data[2:]
+	for len(rest) >= 4 && rest[0] == 0xff && rest[1] != 0xda {
+		length := int(rest[2])<<8 | int(rest[3]) + 2
+		if length < 4 || length > len(rest) {
+			break
+		}
+		if rest[1] == 0xe1 {
+			if o := exifOrientation(rest[4:length]); o != 0 {
+				return o
+			}
+		}
+		rest = rest[length:]
+	}
+	return 1
+}
+
+// orient turns and flips an image the way its EXIF orientation says to.
+func orient(img *image.NRGBA, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			out.SetNRGBA(dx, dy, img.NRGBAAt(x, y))
+		}
+	}
+	return out
+}
+
+// removeVariants deletes the files belonging to the given variants.
+func removeVariants(variants []ImageVariant) {
+	for _, v := range variants {
+		if err := imageStorage.Delete(v.Filename); err != nil && err != ErrNotFound {
+			log.Print(err)
+		}
+	}
+}